@@ -32,6 +32,8 @@ var (
 	endpoint = flag.String("endpoint", "unix:/tmp/csi.sock", "CSI endpoint")
 	nodeID   = flag.String("nodeid", "", "node id")
 
+	enableVolumeStats = flag.Bool("enable-volume-stats", false, "report the usage and the condition of FUSE filesystems by NodeGetVolumeStats. kubelet calls it on every FUSE mount periodically")
+
 	// These are set at compile time.
 	version   = "unknown"
 	builddate = "unknown"
@@ -57,6 +59,8 @@ func main() {
 		Version: version,
 		NodeID:  *nodeID,
 		Mounter: mounter,
+
+		EnableVolumeStats: *enableVolumeStats,
 	}
 
 	d, err := driver.NewDriver(config)
@@ -19,30 +19,225 @@ limitations under the License.
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	starter "github.com/pfnet-research/meta-fuse-csi-plugin/pkg/fuse_starter"
+	proxy "github.com/pfnet-research/meta-fuse-csi-plugin/pkg/fusermount3_proxy"
 	"k8s.io/klog/v2"
 )
 
 var (
-	fdPassingSocketPath = flag.String("fd-passing-socket-path", "", "unix domain socket path for FUSE fd passing")
+	fdPassingSocketPath  = flag.String("fd-passing-socket-path", "", "unix domain socket path for FUSE fd passing")
+	configPath           = flag.String("config", "", "config file in YAML or JSON to run multiple mounters. It cannot be used with fd-passing-socket-path and mounter args")
+	connectTimeout       = flag.Duration("connect-timeout", starter.DefaultConnectTimeout, "time to wait for the fd passing socket created by the CSI driver to become connectable. Zero means a single attempt")
+	fuseFd               = flag.Int("fuse-fd", starter.DefaultFdNumber, "fd number of the FUSE fd in the mounter. {{fd}} and {{fd_path}} in the mounter args are replaced with the fd number and /dev/fd/<fd number>")
+	fuseFdEnv            = flag.String("fuse-fd-env", "", "name of the environment variable to pass the fd number of the FUSE fd to the mounter")
+	logFormat            = flag.String("log-format", string(starter.LogFormatRaw), "format of the mounter output: 'raw' writes each line as is, 'prefix' prefixes each line with the volume name, 'json' writes each line as a JSON object")
+	logBufferLines       = flag.Int("log-buffer-lines", starter.DefaultLogBufferLines, "number of recent lines of the mounter output included in the error on abnormal exit")
+	sandbox              = flag.String("sandbox", "", `sandbox config of the mounter in JSON, e.g. '{"uid":1000,"gid":1000,"noNewPrivs":true}'. See README for the fields`)
+	hooks                = flag.String("hooks", "", `hooks in JSON, e.g. '{"preHandshake":[{"command":["/configure.sh"],"timeout":"30s"}]}'. See README for the hook points`)
+	userNamespace        = flag.Bool("user-namespace", false, "run the mounter as root in a new user namespace, where the uid and gid of fuse-starter are mapped to root")
+	supervise            = flag.Bool("supervise", false, "keep the FUSE fd and restart the mounter when it crashed. Only useful for mounters that can reattach to an existing FUSE session")
+	maxRestarts          = flag.Int("max-restarts", 5, "maximum number of mounter restarts with --supervise. A negative value means unlimited")
+	restartBackoff       = flag.Duration("restart-backoff", time.Second, "initial delay before restarting the mounter with --supervise")
+	maxRestartBackoff    = flag.Duration("max-restart-backoff", time.Minute, "maximum delay before restarting the mounter with --supervise")
+	supervisorStatusFile = flag.String("supervisor-status-file", "", "file to write the supervisor state and restart count as JSON")
+	stopGracePeriod      = flag.Duration("stop-grace-period", 0, "time to wait for the mounter to exit after SIGTERM before sending SIGKILL to its process group. Zero disables SIGKILL")
+	syncBeforeStop       = flag.Bool("sync-before-stop", false, "sync filesystems before sending SIGTERM to the mounter")
+	readyFile            = flag.String("ready-file", "", "file created when the FUSE filesystem answers filesystem operations. Check it with 'fuse-starter probe --ready-file <file>'. Not used with --config")
+	readyAddr            = flag.String("ready-addr", "", "address to serve /ready and /status over HTTP (e.g. ':8080')")
+	readyProbePath       = flag.String("ready-probe-path", "", "path of the FUSE filesystem in this container to probe readiness. It is looked up from the mount table by default. Not used with --config")
+	subreaper            = flag.Bool("subreaper", true, "become a child subreaper to reap orphaned processes forked by the mounter. Zombies are always reaped when fuse-starter runs as PID 1")
+	terminationLogPath   = flag.String("termination-log", starter.DefaultTerminationLogPath, "file to write the reason of a failure, shown by 'kubectl describe pod'. Empty disables it")
+	watchdogInterval     = flag.Duration("watchdog-interval", 0, "interval of statfs probes on the FUSE filesystem to detect a hung mounter. Zero disables the watchdog")
+	watchdogTimeout      = flag.Duration("watchdog-timeout", 10*time.Second, "time a watchdog probe is allowed to take")
+	watchdogThreshold    = flag.Int("watchdog-failure-threshold", 3, "number of consecutive watchdog probe timeouts to kill the mounter and exit")
+	readyProbeInterval   = flag.Duration("ready-probe-interval", time.Second, "interval of readiness probes")
+	controlChannel       = flag.Bool("control-channel", false, "report the state of the mounter to the CSI driver via the fd passing socket")
 	// This is set at compile time.
 	version   = "unknown"
 	builddate = "unknown"
 )
 
+const (
+	// envMountHelperFdPassingSocketPath is the fd passing socket used by the mount helper for any mountpoint.
+	envMountHelperFdPassingSocketPath = "FUSE_STARTER_FD_PASSING_SOCKET_PATH"
+	// envMountHelperMounts maps mountpoints to fd passing sockets for the mount helper, like "<mountpoint>=<socket path>,...".
+	envMountHelperMounts = "FUSE_STARTER_MOUNTS"
+)
+
 func main() {
+	if progName := filepath.Base(os.Args[0]); starter.IsMountHelper(progName) {
+		os.Exit(mountHelper(progName, os.Args[1:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == starter.MountHelperCommand {
+		os.Exit(mountHelper(starter.MountHelperCommand, os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "probe" {
+		os.Exit(probe(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == starter.SandboxExecCommand {
+		// This is executed by fuse-starter itself in place of the mounter. It returns only on failure.
+		err := fmt.Errorf("%w: %w", starter.ErrStartMounter, starter.SandboxExec(os.Args[2:]))
+		fmt.Fprintf(os.Stderr, "fuse-starter %s: %v\n", starter.SandboxExecCommand, err)
+		os.Exit(starter.ExitCode(err))
+	}
+
 	klog.InitFlags(nil)
 	flag.Parse()
 
 	klog.Infof("Running meta-fuse-csi-plugin fuse-starter version %v (BuildDate %v)", version, builddate)
-	klog.Infof("fd-passing-socket-path: %q", *fdPassingSocketPath)
 
+	config, err := loadConfig()
+	if err != nil {
+		klog.Error(err)
+		exit(starter.ExitCodeUsage, fmt.Sprintf("invalid arguments: %v", err))
+	}
+
+	// Reap zombies if orphaned processes are reparented to fuse-starter.
+	reapZombies := os.Getpid() == 1
+	if *subreaper {
+		if err := starter.SetSubreaper(); err != nil {
+			klog.Warningf("failed to become a child subreaper: %v", err)
+		} else {
+			reapZombies = true
+		}
+	}
+	if reapZombies {
+		starter.StartReaper()
+	}
+
+	var volumes []*starter.Volume
+	var statusMu sync.Mutex
+	supervisorConfig := starter.SupervisorConfig{
+		Enabled:         *supervise,
+		MaxRestarts:     *maxRestarts,
+		InitialBackoff:  *restartBackoff,
+		MaxBackoff:      *maxRestartBackoff,
+		StopGracePeriod: *stopGracePeriod,
+		SyncBeforeStop:  *syncBeforeStop,
+		Watchdog: starter.WatchdogConfig{
+			Interval:         *watchdogInterval,
+			Timeout:          *watchdogTimeout,
+			FailureThreshold: *watchdogThreshold,
+		},
+		OnStatusChange: func(status starter.SupervisorStatus) {
+			klog.Infof("[%v] mounter is %v (restarts: %d)", status.VolumeName, status.State, status.Restarts)
+			if *supervisorStatusFile != "" {
+				statusMu.Lock()
+				defer statusMu.Unlock()
+				writeSupervisorStatus(volumes)
+			}
+		},
+	}
+
+	for _, m := range config.Mounters {
+		volumes = append(volumes, starter.NewVolume(m, supervisorConfig, *readyProbeInterval, *readyAddr != ""))
+	}
+
+	if *readyAddr != "" {
+		go serveReadiness(*readyAddr, volumes)
+	}
+
+	// Each volume is handled independently. A failing mounter does not stop the others,
+	// except a hung one, which needs the container to be restarted.
+	var wg sync.WaitGroup
+	hung := make(chan struct{})
+	var hungOnce sync.Once
+	for _, v := range volumes {
+		wg.Add(1)
+		go func(v *starter.Volume) {
+			defer wg.Done()
+			if err := v.Run(); err != nil {
+				klog.Errorf("[%v] mounter exited with error: %v\n", v.Name(), err)
+				if errors.Is(err, starter.ErrHung) {
+					hungOnce.Do(func() { close(hung) })
+				}
+			}
+		}(v)
+	}
+	allDone := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(allDone)
+	}()
+
+	// Forward signals which daemons use for log rotation and reload.
+	starter.ForwardSignals(volumes)
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGTERM)
+	klog.Info("waiting for SIGTERM signal...")
+
+	select {
+	case <-c:
+		klog.Info("received SIGTERM signal, waiting for all the mounter processes exit...")
+		stopVolumes(volumes)
+	case <-hung:
+		klog.Error("a mounter was hung, stopping the other mounter processes to exit...")
+		stopVolumes(volumes)
+	case <-allDone:
+		klog.Info("all the mounter processes exited")
+	}
+
+	// The exit code is the one of the first failed volume, and the message lists all the failures.
+	exitCode := 0
+	messages := []string{}
+	for _, v := range volumes {
+		err := v.Err()
+		code := starter.ExitCode(err)
+		if code == 0 {
+			continue
+		}
+		if exitCode == 0 {
+			exitCode = code
+		}
+		messages = append(messages, fmt.Sprintf("[%v] exit code %d: %v", v.Name(), code, err))
+	}
+	exit(exitCode, strings.Join(messages, "\n"))
+}
+
+// stopVolumes stops all the volumes and waits for their mounter processes to exit.
+// The volumes are stopped concurrently, since each may sync filesystems and wait for the grace period.
+func stopVolumes(volumes []*starter.Volume) {
+	var wg sync.WaitGroup
+	for _, v := range volumes {
+		wg.Add(1)
+		go func(v *starter.Volume) {
+			defer wg.Done()
+			v.Stop()
+			v.Wait()
+		}(v)
+	}
+	wg.Wait()
+}
+
+// exit writes the termination message if the exit code is not 0, and exits fuse-starter.
+func exit(exitCode int, message string) {
+	if exitCode != 0 && *terminationLogPath != "" {
+		if err := starter.WriteTerminationMessage(*terminationLogPath, message); err != nil {
+			klog.Warningf("failed to write termination message to %q: %v", *terminationLogPath, err)
+		}
+	}
+	klog.Infof("exiting fuse-starter with exit code %d...", exitCode)
+	klog.Flush()
+	os.Exit(exitCode)
+}
+
+// loadConfig reads the config file given by --config,
+// or builds the config for a mounter from --fd-passing-socket-path and the command args after "--".
+func loadConfig() (*starter.Config, error) {
 	// parsing command args after "--"
 	mounterArgsIdx := 0
 	for ; mounterArgsIdx < len(os.Args); mounterArgsIdx += 1 {
@@ -52,71 +247,220 @@ func main() {
 		}
 	}
 
-	if len(os.Args) == mounterArgsIdx {
-		klog.Error("mounter does not specified")
-		return
+	if *watchdogInterval > 0 && (*watchdogTimeout <= 0 || *watchdogThreshold < 1) {
+		return nil, fmt.Errorf("watchdog-timeout must be positive and watchdog-failure-threshold must be at least 1")
+	}
+
+	var sandboxConfig *starter.SandboxConfig
+	if *sandbox != "" {
+		sandboxConfig = &starter.SandboxConfig{}
+		if err := json.Unmarshal([]byte(*sandbox), sandboxConfig); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal sandbox: %w", err)
+		}
+		if err := sandboxConfig.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid sandbox: %w", err)
+		}
 	}
 
-	mounterPath := os.Args[mounterArgsIdx]
-	mounterArgs := os.Args[mounterArgsIdx+1:]
-	klog.Infof("mounter(%s) args are %v", mounterPath, mounterArgs)
+	var hooksConfig *starter.HooksConfig
+	if *hooks != "" {
+		hooksConfig = &starter.HooksConfig{}
+		if err := json.Unmarshal([]byte(*hooks), hooksConfig); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal hooks: %w", err)
+		}
+		if err := hooksConfig.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid hooks: %w", err)
+		}
+	}
+
+	var userNamespaceConfig *starter.UserNamespaceConfig
+	if *userNamespace {
+		userNamespaceConfig = &starter.UserNamespaceConfig{}
+	}
+
+	if *configPath != "" {
+		if *fdPassingSocketPath != "" || len(os.Args) != mounterArgsIdx {
+			return nil, fmt.Errorf("config cannot be used with fd-passing-socket-path and mounter args")
+		}
+		klog.Infof("config: %q", *configPath)
+
+		config, err := starter.LoadConfig(*configPath)
+		if err != nil {
+			return nil, err
+		}
+		for i := range config.Mounters {
+			if config.Mounters[i].FuseFd == nil {
+				config.Mounters[i].FuseFd = fuseFd
+			}
+			if config.Mounters[i].FuseFdEnv == "" {
+				config.Mounters[i].FuseFdEnv = *fuseFdEnv
+			}
+			if config.Mounters[i].ConnectTimeout == "" {
+				config.Mounters[i].ConnectTimeout = connectTimeout.String()
+			}
+			if config.Mounters[i].Sandbox == nil {
+				config.Mounters[i].Sandbox = sandboxConfig
+			}
+			if config.Mounters[i].Hooks == nil {
+				config.Mounters[i].Hooks = hooksConfig
+			}
+			if config.Mounters[i].UserNamespace == nil {
+				config.Mounters[i].UserNamespace = userNamespaceConfig
+			}
+			if config.Mounters[i].LogFormat == "" {
+				config.Mounters[i].LogFormat = *logFormat
+			}
+			if config.Mounters[i].LogBufferLines == nil {
+				config.Mounters[i].LogBufferLines = logBufferLines
+			}
+			if config.Mounters[i].ControlChannel == nil {
+				config.Mounters[i].ControlChannel = controlChannel
+			}
+		}
+		// The flags filled above may conflict with the config, like --sandbox and userNamespace.
+		if err := config.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid config %q with the flags: %w", *configPath, err)
+		}
+
+		return config, nil
+	}
+
+	klog.Infof("fd-passing-socket-path: %q", *fdPassingSocketPath)
+
+	if len(os.Args) == mounterArgsIdx {
+		return nil, fmt.Errorf("mounter does not specified")
+	}
 
 	if *fdPassingSocketPath == "" {
-		klog.Error("fd-passing-socket-path does not specified")
-		return
+		return nil, fmt.Errorf("fd-passing-socket-path does not specified")
 	}
 
-	mounter := starter.New(mounterPath, mounterArgs)
-	var wg sync.WaitGroup
+	config := &starter.Config{
+		Mounters: []starter.MounterConfig{
+			{
+				FdPassingSocketPath: *fdPassingSocketPath,
+				MounterPath:         os.Args[mounterArgsIdx],
+				Args:                os.Args[mounterArgsIdx+1:],
+				FuseFd:              fuseFd,
+				ConnectTimeout:      connectTimeout.String(),
+				FuseFdEnv:           *fuseFdEnv,
+				LogFormat:           *logFormat,
+				LogBufferLines:      logBufferLines,
+				Sandbox:             sandboxConfig,
+				UserNamespace:       userNamespaceConfig,
+				Hooks:               hooksConfig,
+				ReadyFile:           *readyFile,
+				ReadyProbePath:      *readyProbePath,
+				ControlChannel:      controlChannel,
+			},
+		},
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// writeSupervisorStatus writes the status of all volumes to the file specified by --supervisor-status-file.
+func writeSupervisorStatus(volumes []*starter.Volume) {
+	statuses := make([]starter.SupervisorStatus, 0, len(volumes))
+	for _, v := range volumes {
+		statuses = append(statuses, v.Status())
+	}
 
-	mc, err := starter.PrepareMountConfig(*fdPassingSocketPath)
+	b, err := json.Marshal(statuses)
 	if err != nil {
-		klog.Errorf("failed prepare mount config: socket path %q: %v\n", *fdPassingSocketPath, err)
+		klog.Warningf("failed to marshal supervisor status: %v", err)
 		return
 	}
+	// Write and rename to avoid readers seeing a partially written file.
+	tmp := *supervisorStatusFile + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		klog.Warningf("failed to write supervisor status to %q: %v", tmp, err)
+		return
+	}
+	if err := os.Rename(tmp, *supervisorStatusFile); err != nil {
+		klog.Warningf("failed to rename %q to %q: %v", tmp, *supervisorStatusFile, err)
+	}
+}
 
-	c := make(chan os.Signal, 1)
-
-	wg.Add(1)
-	go func(mc *starter.MountConfig) {
-		defer wg.Done()
-		cmd, err := mounter.Mount(mc)
-		if err != nil {
-			klog.Errorf("failed to mount volume %q: %v\n", mc.VolumeName, err)
-			return
+// serveReadiness serves the readiness of all volumes at /ready and their status at /status.
+func serveReadiness(addr string, volumes []*starter.Volume) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ready", func(w http.ResponseWriter, _ *http.Request) {
+		for _, v := range volumes {
+			if !v.Ready() {
+				http.Error(w, fmt.Sprintf("volume %q is not ready", v.Name()), http.StatusServiceUnavailable)
+				return
+			}
 		}
-
-		if err = cmd.Start(); err != nil {
-			klog.Errorf("failed to start mounter with error: %v\n", err)
-			return
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, _ *http.Request) {
+		statuses := make([]starter.SupervisorStatus, 0, len(volumes))
+		for _, v := range volumes {
+			statuses = append(statuses, v.Status())
 		}
-
-		// Since the mounter has taken over the file descriptor,
-		// closing the file descriptor to avoid other process forking it.
-		syscall.Close(mc.FileDescriptor)
-		if err = cmd.Wait(); err != nil {
-			klog.Errorf("mounter exited with error: %v\n", err)
-		} else {
-			klog.Infof("[%v] mounter exited normally.", mc.VolumeName)
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(statuses); err != nil {
+			klog.Warningf("failed to write supervisor status: %v", err)
 		}
+	})
+
+	klog.Infof("serving readiness at %q", addr)
+	//nolint:gosec
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		klog.Errorf("failed to serve readiness at %q: %v", addr, err)
+	}
+}
 
-		// Process may exit early.
-		c <- syscall.SIGTERM
-	}(mc)
+// probe implements 'fuse-starter probe' for exec probes.
+// It returns 0 if the ready file exists, otherwise 1.
+func probe(args []string) int {
+	fs := flag.NewFlagSet("probe", flag.ExitOnError)
+	readyFile := fs.String("ready-file", "", "ready file created by fuse-starter with --ready-file")
+	//nolint:errcheck
+	fs.Parse(args)
 
-	signal.Notify(c, syscall.SIGTERM)
-	klog.Info("waiting for SIGTERM signal...")
+	if *readyFile == "" {
+		fmt.Fprintln(os.Stderr, "ready-file is not specified")
+		return 1
+	}
+	if _, err := os.Stat(*readyFile); err != nil {
+		fmt.Fprintf(os.Stderr, "not ready: %v\n", err)
+		return 1
+	}
 
-	<-c // blocking the process
+	return 0
+}
 
-	klog.Info("received SIGTERM signal, waiting for all the mounter processes exit...")
+// mountHelper implements the mount helper accepting the command line of mount.fuse3.
+// It executes the FUSE daemon with the FUSE fd received from the CSI driver, and returns only on failure.
+func mountHelper(progName string, args []string) int {
+	a, err := starter.ParseMountHelperArgs(progName, args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", progName, err)
+		return starter.ExitCodeUsage
+	}
 
-	// TODO: send SIGKILL to kill hang mounter process
-	err = mounter.Cmd.Process.Signal(syscall.SIGTERM)
+	mounts, err := proxy.ParseMounts(os.Getenv(envMountHelperMounts))
 	if err != nil {
-		klog.Warning("failed to send SIGTERM signal to mounter process")
+		fmt.Fprintf(os.Stderr, "%s: invalid %s: %v\n", progName, envMountHelperMounts, err)
+		return starter.ExitCodeUsage
+	}
+	routes, err := proxy.NewRoutes(mounts, os.Getenv(envMountHelperFdPassingSocketPath))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v: specify %s or %s\n", progName, err, envMountHelperMounts, envMountHelperFdPassingSocketPath)
+		return starter.ExitCodeUsage
+	}
+	sp, err := routes.SocketPath(a.MountPoint)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", progName, err)
+		return starter.ExitCodeUsage
 	}
-	wg.Wait()
 
-	klog.Info("exiting fuse-starter...")
+	err = starter.RunMountHelper(a, sp, starter.DefaultConnectTimeout)
+	fmt.Fprintf(os.Stderr, "%s: %v\n", progName, err)
+	return starter.ExitCode(err)
 }
@@ -18,21 +18,24 @@ package main
 
 import (
 	"fmt"
+	"net"
 	"os"
-	"strconv"
+	"os/signal"
+	"path/filepath"
 	"syscall"
+	"time"
 
 	starter "github.com/pfnet-research/meta-fuse-csi-plugin/pkg/fuse_starter"
-	"github.com/pfnet-research/meta-fuse-csi-plugin/pkg/util"
+	proxy "github.com/pfnet-research/meta-fuse-csi-plugin/pkg/fusermount3_proxy"
 	flag "github.com/spf13/pflag"
 
 	"k8s.io/klog/v2"
 )
 
 var (
-	optUnmount     = flag.BoolP("unmount", "u", false, "unmount (NOT SUPPORTED)")
-	optAutoUnmount = flag.BoolP("auto-unmount", "U", false, "auto-unmount (NOT SUPPORTED)")
-	optLazy        = flag.BoolP("lazy", "z", false, "lazy umount (NOT SUPPORTED)")
+	optUnmount     = flag.BoolP("unmount", "u", false, "unmount")
+	optAutoUnmount = flag.BoolP("auto-unmount", "U", false, "unmount when the FUSE daemon exits")
+	optLazy        = flag.BoolP("lazy", "z", false, "lazy unmount")
 	optQuiet       = flag.BoolP("quiet", "q", false, "quiet (NOT SUPPORTED)")
 	optHelp        = flag.BoolP("help", "h", false, "print help")
 	optVersion     = flag.BoolP("version", "V", false, "print version")
@@ -43,18 +46,33 @@ var (
 )
 
 var ignoredOptions = map[string]*bool{
-	"unmount":      optUnmount,
-	"auto-unmount": optAutoUnmount,
-	"lazy":         optLazy,
-	"optQuiet":     optQuiet,
+	"optQuiet": optQuiet,
 }
 
 const (
-	ENV_FUSE_COMMFD                         = "_FUSE_COMMFD"
 	ENV_FUSERMOUNT3PROXY_FDPASSING_SOCKPATH = "FUSERMOUNT3PROXY_FDPASSING_SOCKPATH"
+	ENV_FUSERMOUNT3PROXY_CONNECT_TIMEOUT    = "FUSERMOUNT3PROXY_CONNECT_TIMEOUT"
+	ENV_FUSERMOUNT3PROXY_MOUNTS             = "FUSERMOUNT3PROXY_MOUNTS"
+	ENV_FUSERMOUNT3PROXY_CONFIG             = "FUSERMOUNT3PROXY_CONFIG"
+
+	// tokenFileSuffix is appended to the fd-passing socket path to store the token of the mount for unmount.
+	tokenFileSuffix = ".token"
+)
+
+var (
+	// progName is the name fusermount3-proxy is invoked as. It prefixes error messages like fusermount3.
+	progName = "fusermount3"
+	// commConn is the comm socket of libfuse, which is closed on failure.
+	commConn net.Conn
 )
 
 func main() {
+	var err error
+	if len(os.Args) > 1 && os.Args[1] == proxy.InstallCommand {
+		runInstall(os.Args[2:])
+		return
+	}
+
 	klog.InitFlags(nil)
 	flag.Parse()
 
@@ -70,31 +88,70 @@ func main() {
 
 	klog.Infof("Running meta-fuse-csi-plugin fusermount3-proxy version %v (BuildDate %v)", version, builddate)
 
-	if *optUnmount {
-		klog.Warning("'unmount' is not supported.")
-		os.Exit(0)
+	progName = filepath.Base(os.Args[0])
+	fuse2 := proxy.IsFuse2(progName)
+	if fuse2 {
+		klog.Infof("invoked as %q, emulating fusermount of libfuse2", progName)
+		// fusermount of libfuse2 has no option for auto_unmount, which is passed with "-o auto_unmount".
+		if flag.CommandLine.Changed("auto-unmount") {
+			fail("invalid option -- 'U'")
+		}
+	}
+
+	if !*optUnmount {
+		// get unix domain socket from caller first to close it on any failure
+		commConn, err = proxy.CommConn(os.Getenv(proxy.EnvCommFd))
+		if err != nil {
+			fail("%v", err)
+		}
+		klog.Infof("net.Conn is acquired from %s", proxy.EnvCommFd)
 	}
 
 	if len(flag.Args()) == 0 {
-		klog.Error("mountpoint is not specified.")
-		os.Exit(1)
+		fail("missing mountpoint argument")
 	}
 
-	if *optOptions == "" {
-		klog.Error("options is not specified.")
-		os.Exit(1)
+	mntPoint := flag.Args()[0]
+
+	// fd-passing sockets between fusermount3-proxy and csi-driver are mapped to mountpoints by env vars
+	routes, err := loadRoutes()
+	if err != nil {
+		fail("%v", err)
 	}
+	fdPassingSocketPath, err := routes.SocketPath(mntPoint)
+	if err != nil {
+		fail("%v", err)
+	}
+	klog.Infof("fd-passing socket path for mountpoint %q is %q", mntPoint, fdPassingSocketPath)
+	tokenPath := fdPassingSocketPath + tokenFileSuffix
 
-	// fd-passing socket between fusermount3-proxy and csi-driver is passed as env var
-	fdPassingSocketPath := os.Getenv(ENV_FUSERMOUNT3PROXY_FDPASSING_SOCKPATH)
-	if fdPassingSocketPath == "" {
-		klog.Errorf("environment variable %q is not specified.", ENV_FUSERMOUNT3PROXY_FDPASSING_SOCKPATH)
-		os.Exit(1)
+	if *optUnmount {
+		// The token is saved by fusermount3-proxy which mounted the filesystem.
+		token, err := os.ReadFile(tokenPath)
+		if err != nil {
+			fail("failed to unmount %s: %v", mntPoint, err)
+		}
+		if err := starter.RequestUnmount(fdPassingSocketPath, string(token), *optLazy); err != nil {
+			fail("failed to unmount %s: %v", mntPoint, err)
+		}
+		if err := os.Remove(tokenPath); err != nil {
+			klog.Warningf("failed to remove the token of the mount: %v", err)
+		}
+		klog.Infof("unmounted %q", mntPoint)
+		os.Exit(0)
 	}
-	klog.Infof("fd-passing socket path is %q", fdPassingSocketPath)
 
-	mntPoint := flag.Args()[0]
-	klog.Infof("mountpoint is %q, but ignored.", mntPoint)
+	if *optOptions == "" {
+		fail("options is not specified")
+	}
+
+	connectTimeout := starter.DefaultConnectTimeout
+	if v := os.Getenv(ENV_FUSERMOUNT3PROXY_CONNECT_TIMEOUT); v != "" {
+		connectTimeout, err = time.ParseDuration(v)
+		if err != nil || connectTimeout < 0 {
+			fail("invalid %s=%q", ENV_FUSERMOUNT3PROXY_CONNECT_TIMEOUT, v)
+		}
+	}
 
 	for k, v := range ignoredOptions {
 		if *v {
@@ -102,40 +159,113 @@ func main() {
 		}
 	}
 
-	// TODO: send options to csi-driver and use them?
-	klog.Infof("options=%q", *optOptions)
+	options, autoUnmountOption := proxy.ParseOptions(*optOptions, fuse2)
+	klog.Infof("options=%q", options)
 
-	// get unix domain socket from caller
-	commFdStr := os.Getenv(ENV_FUSE_COMMFD)
-	commFd, err := strconv.Atoi(commFdStr)
+	// get fd for /dev/fuse from csi-driver
+	mc, err := starter.PrepareMountConfig(fdPassingSocketPath, connectTimeout, options)
 	if err != nil {
-		klog.Errorf("failed to get commFd _FUSE_COMMFD=%q", commFdStr)
-		os.Exit(1)
+		fail("mount failed: %v", err)
+	}
+	klog.Infof("received fd for /dev/fuse from csi-driver via socket %q", fdPassingSocketPath)
+
+	// Save the token for fusermount3-proxy -u, which runs as another process.
+	if err := os.WriteFile(tokenPath, []byte(mc.Token), 0o600); err != nil {
+		klog.Warningf("failed to save the token of the mount, unmount will be refused: %v", err)
 	}
-	klog.Infof("commFd from %q is %d", ENV_FUSE_COMMFD, commFd)
 
-	commConn, err := util.GetNetConnFromRawUnixSocketFd(commFd)
+	// now already FUSE-fs mounted and fd is ready.
+	err = proxy.SendFuseFd(commConn, mc.FileDescriptor)
+	// Do not keep the FUSE connection alive after the FUSE daemon exits.
+	syscall.Close(mc.FileDescriptor)
 	if err != nil {
-		klog.Errorf("failed to convert commFd to net.Conn: %w", err)
+		fail("failed to send file descriptor: %v", err)
+	}
+	klog.Infof("sent fd for /dev/fuse via commFd")
+
+	// libfuse3 passes "-o auto_unmount" to fusermount3 before 3.14 and "--auto-unmount" since then.
+	if *optAutoUnmount || autoUnmountOption {
+		autoUnmount(commConn, mntPoint, fdPassingSocketPath, tokenPath, mc.Token)
+	}
+
+	klog.Info("exiting fusermount3-proxy...")
+}
+
+// runInstall implements the install subcommand, which is run in an init container
+// to use fusermount3-proxy in a FUSE container from an image without it.
+func runInstall(args []string) {
+	fs := flag.NewFlagSet(proxy.InstallCommand, flag.ExitOnError)
+	dir := fs.String("dir", "", "directory to install fusermount3-proxy into, e.g. an emptyDir shared with the FUSE container")
+	sockPath := fs.String("fd-passing-socket-path", "", "path of the fd-passing socket in the FUSE container, shown in the instructions")
+	//nolint:errcheck
+	fs.Parse(args)
+
+	if *dir == "" {
+		fmt.Fprintf(os.Stderr, "usage: %s %s --dir <directory> [--fd-passing-socket-path <path>]\n", os.Args[0], proxy.InstallCommand)
 		os.Exit(1)
 	}
-	klog.Infof("net.Conn is acquired from fd %d", commFd)
 
-	// get fd for /dev/fuse from csi-driver
-	mc, err := starter.PrepareMountConfig(fdPassingSocketPath)
-	if err != nil {
-		klog.Errorf("failed to prepare mount config: socket path %q: %w", fdPassingSocketPath, err)
+	if err := proxy.Install(*dir, *sockPath, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to install fusermount3-proxy: %v\n", err)
 		os.Exit(1)
 	}
-	defer syscall.Close(mc.FileDescriptor)
-	klog.Infof("received fd for /dev/fuse from csi-driver via socket %q", fdPassingSocketPath)
+}
 
-	// now already FUSE-fs mounted and fd is ready.
-	err = util.SendMsg(commConn, mc.FileDescriptor, []byte{0})
+// fail reports the error like fusermount3 and exits with 1.
+// The message goes to stderr prefixed with the program name, where libfuse and the FUSE daemon show it.
+// The comm socket is closed so that libfuse does not wait for the fd anymore.
+func fail(format string, args ...interface{}) {
+	if commConn != nil {
+		commConn.Close()
+	}
+	klog.Flush()
+	fmt.Fprintf(os.Stderr, "%s: %s\n", progName, fmt.Sprintf(format, args...))
+	os.Exit(1)
+}
+
+// loadRoutes reads the mappings from mountpoints to fd-passing sockets.
+// The single socket of ENV_FUSERMOUNT3PROXY_FDPASSING_SOCKPATH is used for any mountpoint only if no mapping is specified.
+func loadRoutes() (*proxy.Routes, error) {
+	mounts, err := proxy.ParseMounts(os.Getenv(ENV_FUSERMOUNT3PROXY_MOUNTS))
 	if err != nil {
-		klog.Errorf("failed to send fd via commFd: %w", err)
-		os.Exit(1)
+		return nil, fmt.Errorf("invalid %s: %w", ENV_FUSERMOUNT3PROXY_MOUNTS, err)
+	}
+	if configPath := os.Getenv(ENV_FUSERMOUNT3PROXY_CONFIG); configPath != "" {
+		config, err := proxy.LoadConfig(configPath)
+		if err != nil {
+			return nil, err
+		}
+		mounts = append(mounts, config.Mounts...)
+	}
+
+	fallback := os.Getenv(ENV_FUSERMOUNT3PROXY_FDPASSING_SOCKPATH)
+	if len(mounts) > 0 && fallback != "" {
+		klog.Warningf("%s is ignored since mountpoints are mapped to fd-passing sockets", ENV_FUSERMOUNT3PROXY_FDPASSING_SOCKPATH)
+	}
+
+	routes, err := proxy.NewRoutes(mounts, fallback)
+	if err != nil {
+		return nil, fmt.Errorf("%w: specify %s, %s or %s", err, ENV_FUSERMOUNT3PROXY_MOUNTS, ENV_FUSERMOUNT3PROXY_CONFIG, ENV_FUSERMOUNT3PROXY_FDPASSING_SOCKPATH)
+	}
+
+	return routes, nil
+}
+
+// autoUnmount stays resident like fusermount3 with auto_unmount and unmounts the filesystem
+// when the FUSE daemon closes its end of commConn, i.e. exits or crashes.
+func autoUnmount(commConn net.Conn, mntPoint, fdPassingSocketPath, tokenPath, token string) {
+	// Like fusermount3, leave the session and ignore signals sent to the FUSE daemon,
+	// e.g. Ctrl-C, not to exit before it.
+	if _, err := syscall.Setsid(); err != nil {
+		klog.V(4).Infof("failed to create a new session: %v", err)
+	}
+	signal.Ignore(syscall.SIGHUP, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM)
+	// Do not keep the mountpoint busy.
+	if err := os.Chdir("/"); err != nil {
+		klog.Warningf("failed to change directory to /: %v", err)
+	}
+
+	if err := proxy.AutoUnmount(commConn, mntPoint, fdPassingSocketPath, tokenPath, token); err != nil {
+		fail("%v", err)
 	}
-	klog.Infof("sent fd for /dev/fuse via commFd %d", commFd)
-	klog.Info("exiting fusermount3-proxy...")
 }
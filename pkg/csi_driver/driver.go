@@ -33,6 +33,9 @@ type DriverConfig struct {
 	Version string // Driver version
 	NodeID  string // Node name
 	Mounter mount.Interface
+	// EnableVolumeStats advertises GET_VOLUME_STATS and VOLUME_CONDITION.
+	// kubelet then runs statfs(2) on every FUSE mount periodically, which may be a round-trip to the remote storage.
+	EnableVolumeStats bool
 }
 
 type Driver struct {
@@ -72,6 +75,9 @@ func NewDriver(config *DriverConfig) (*Driver, error) {
 
 	driver.ids = newIdentityServer(driver)
 	nscap := []csi.NodeServiceCapability_RPC_Type{}
+	if config.EnableVolumeStats {
+		nscap = append(nscap, csi.NodeServiceCapability_RPC_GET_VOLUME_STATS, csi.NodeServiceCapability_RPC_VOLUME_CONDITION)
+	}
 	driver.ns = newNodeServer(driver, config.Mounter)
 	driver.addNodeServiceCapabilities(nscap)
 
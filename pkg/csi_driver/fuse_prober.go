@@ -0,0 +1,110 @@
+/*
+Copyright 2023 Preferred Networks, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// fuseProber runs stat(2) and statfs(2) on the target paths of FUSE mounts, giving up after timeout.
+// A hung FUSE daemon blocks them forever, so the probe runs in another goroutine,
+// and a new probe is not started on a target path while the previous one is blocked, like the watchdog of fuse-starter.
+type fuseProber struct {
+	statFunc   func(path string) error
+	statfsFunc func(path string, st *syscall.Statfs_t) error
+	timeout    time.Duration
+
+	mu sync.Mutex
+	// pending are the probes not returned yet. key is the syscall and the target path.
+	pending map[string]*fuseProbe
+}
+
+// fuseProbe is the result of a probe, which is set before done is closed.
+type fuseProbe struct {
+	done chan struct{}
+	st   syscall.Statfs_t
+	err  error
+}
+
+func newFuseProber() *fuseProber {
+	return &fuseProber{
+		statFunc: func(path string) error {
+			_, err := os.Stat(path)
+			return err
+		},
+		statfsFunc: syscall.Statfs,
+		timeout:    FuseConnectionCheckTimeout,
+		pending:    map[string]*fuseProbe{},
+	}
+}
+
+// start returns the pending probe of key, or starts run as a new probe.
+func (p *fuseProber) start(key string, run func(*fuseProbe)) *fuseProbe {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if probe, ok := p.pending[key]; ok {
+		return probe
+	}
+	probe := &fuseProbe{done: make(chan struct{})}
+	p.pending[key] = probe
+	go func() {
+		run(probe)
+		p.mu.Lock()
+		delete(p.pending, key)
+		p.mu.Unlock()
+		close(probe.done)
+	}()
+
+	return probe
+}
+
+// wait waits for probe up to timeout.
+func (p *fuseProber) wait(probe *fuseProbe, name string, targetPath string) error {
+	select {
+	case <-probe.done:
+		return probe.err
+	case <-time.After(p.timeout):
+		return fmt.Errorf("%s on %q did not return within %v", name, targetPath, p.timeout)
+	}
+}
+
+// checkConnection stats the target path to see if the FUSE daemon still serves the mount.
+func (p *fuseProber) checkConnection(targetPath string) error {
+	probe := p.start("stat:"+targetPath, func(probe *fuseProbe) {
+		probe.err = p.statFunc(targetPath)
+	})
+
+	return p.wait(probe, "stat", targetPath)
+}
+
+// statfs is statfs(2) on the target path.
+func (p *fuseProber) statfs(targetPath string) (*syscall.Statfs_t, error) {
+	probe := p.start("statfs:"+targetPath, func(probe *fuseProbe) {
+		probe.err = p.statfsFunc(targetPath, &probe.st)
+	})
+	if err := p.wait(probe, "statfs", targetPath); err != nil {
+		return nil, err
+	}
+	st := probe.st
+
+	return &st, nil
+}
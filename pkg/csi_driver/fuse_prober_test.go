@@ -0,0 +1,108 @@
+/*
+Copyright 2023 Preferred Networks, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"errors"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestFuseProberReusesPendingProbe(t *testing.T) {
+	t.Parallel()
+
+	var calls atomic.Int32
+	unblock := make(chan struct{})
+	p := newFuseProber()
+	p.timeout = 50 * time.Millisecond
+	p.statFunc = func(_ string) error {
+		calls.Add(1)
+		<-unblock
+		return syscall.ENOTCONN
+	}
+
+	// The hung probe is reused instead of leaking a goroutine per check.
+	for i := 0; i < 3; i++ {
+		if err := p.checkConnection("/target"); err == nil {
+			t.Errorf("Expected error but got none")
+		}
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("Got %d probes, but expected 1", n)
+	}
+
+	close(unblock)
+	p.timeout = time.Second
+	if err := p.checkConnection("/target"); !errors.Is(err, syscall.ENOTCONN) {
+		t.Errorf("Got error %v, but expected %v", err, syscall.ENOTCONN)
+	}
+	// A probe returned is not reused.
+	if err := p.checkConnection("/target"); !errors.Is(err, syscall.ENOTCONN) {
+		t.Errorf("Got error %v, but expected %v", err, syscall.ENOTCONN)
+	}
+	if n := calls.Load(); n != 2 {
+		t.Errorf("Got %d probes, but expected 2", n)
+	}
+}
+
+func TestFuseProberStatfs(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name          string
+		statfsErr     error
+		expectedError bool
+	}{
+		{
+			name: "should return the result of statfs",
+		},
+		{
+			name:          "should return the error of statfs",
+			statfsErr:     syscall.ECONNABORTED,
+			expectedError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+
+		p := newFuseProber()
+		p.statfsFunc = func(_ string, st *syscall.Statfs_t) error {
+			st.Blocks = 10
+			return tc.statfsErr
+		}
+
+		st, err := p.statfs("/target")
+		if tc.expectedError {
+			if !errors.Is(err, tc.statfsErr) {
+				t.Errorf("Got error %v, but expected %v", err, tc.statfsErr)
+			}
+
+			continue
+		}
+		if err != nil {
+			t.Errorf("Did not expect error but got: %v", err)
+
+			continue
+		}
+		if st.Blocks != 10 {
+			t.Errorf("Got %d blocks, but expected 10", st.Blocks)
+		}
+	}
+}
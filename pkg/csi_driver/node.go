@@ -19,6 +19,7 @@ limitations under the License.
 package driver
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
@@ -26,6 +27,7 @@ import (
 
 	csi "github.com/container-storage-interface/spec/lib/go/csi"
 	csimounter "github.com/pfnet-research/meta-fuse-csi-plugin/pkg/csi_mounter"
+	starter "github.com/pfnet-research/meta-fuse-csi-plugin/pkg/fuse_starter"
 	"github.com/pfnet-research/meta-fuse-csi-plugin/pkg/util"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc/codes"
@@ -46,8 +48,10 @@ const (
 	VolumeContextKeyMountOptions          = "mountOptions"
 	VolumeContextKeyFdPassingEmptyDirName = "fdPassingEmptyDirName"
 	VolumeContextKeyFdPassingSocketName   = "fdPassingSocketName"
+	VolumeContextKeyAllowRemount          = "allowRemount"
 
-	UmountTimeout = time.Second * 5
+	UmountTimeout              = time.Second * 5
+	FuseConnectionCheckTimeout = time.Second * 5
 )
 
 // nodeServer handles mounting and unmounting of GCS FUSE volumes on a node.
@@ -55,13 +59,24 @@ type nodeServer struct {
 	driver      *Driver
 	mounter     mount.Interface
 	volumeLocks *util.VolumeLocks
+	prober      *fuseProber
+	// emptyDirPath returns the path of the emptyDir of a Pod on the node.
+	emptyDirPath func(podID, emptyDirName string) string
 }
 
 func newNodeServer(driver *Driver, mounter mount.Interface) csi.NodeServer {
+	prober := newFuseProber()
+	if csiMounter, ok := mounter.(*csimounter.Mounter); ok {
+		// A restarted sidecar can mount the target again if the FUSE connection of the previous one is lost.
+		csiMounter.CheckConnection = prober.checkConnection
+	}
+
 	return &nodeServer{
-		driver:      driver,
-		mounter:     mounter,
-		volumeLocks: util.NewVolumeLocks(),
+		driver:       driver,
+		mounter:      mounter,
+		volumeLocks:  util.NewVolumeLocks(),
+		prober:       prober,
+		emptyDirPath: util.GetEmptyDirPath,
 	}
 }
 
@@ -92,6 +107,10 @@ func (s *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublish
 	if mountOptions, ok := vc[VolumeContextKeyMountOptions]; ok {
 		fuseMountOptions = joinMountOptions(fuseMountOptions, strings.Split(mountOptions, ","))
 	}
+	if vc[VolumeContextKeyAllowRemount] == "true" {
+		// The containers see the new mount only with HostToContainer propagation.
+		fuseMountOptions = joinMountOptions(fuseMountOptions, []string{csimounter.AllowRemountOption})
+	}
 
 	if vc[VolumeContextKeyEphemeral] != "true" {
 		return nil, status.Errorf(codes.InvalidArgument, "NodePublishVolume VolumeContext %q must be provided for ephemeral storage", VolumeContextKeyEphemeral)
@@ -134,25 +153,55 @@ func (s *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublish
 		return nil, status.Errorf(codes.Internal, "failed to check if path %q is already mounted: %v", targetPath, err)
 	}
 
+	// rearmed is set when a dead FUSE mount is detached on republish
+	// so that a restarted sidecar can handshake again.
+	rearmed := false
 	if mounted {
-		// Already mounted
-		klog.V(4).Infof("NodePublishVolume succeeded on volume %q to target path %q, mount already exists.", volumeName, targetPath)
+		// kubelet periodically calls NodePublishVolume because of requiresRepublish.
+		// Use it to check whether the FUSE daemon behind the mount is still alive.
+		err := s.prober.checkConnection(targetPath)
+		if !csimounter.IsConnectionLost(err) {
+			if err != nil {
+				klog.Warningf("failed to check the FUSE connection on target path %q: %v", targetPath, err)
+			}
+			// Already mounted
+			if err := s.mountError(targetPath); err != nil {
+				// The failure was after the mount, like sending the fd. The mount is served by another attempt.
+				klog.Warningf("ignoring the mount failure on target path %q since the mount exists", targetPath)
+			}
+			klog.V(4).Infof("NodePublishVolume succeeded on volume %q to target path %q, mount already exists.", volumeName, targetPath)
 
-		return &csi.NodePublishVolumeResponse{}, nil
+			return &csi.NodePublishVolumeResponse{}, nil
+		}
+
+		klog.Warningf("FUSE connection on target path %q is lost (%v), detaching the mount to re-arm the fd-passing socket", targetPath, err)
+		if err := s.unmountTarget(targetPath); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to detach dead FUSE mount on target path %q: %v", targetPath, err)
+		}
+		// The socket of the dead mount is still open. Close it to create a new one below.
+		s.closeFdPassingSocket(targetPath)
+		rearmed = true
 	}
 
-	emptyDir := util.GetEmptyDirPath(podId, fdPassingEmptyDirName)
+	emptyDir := s.emptyDirPath(podId, fdPassingEmptyDirName)
 	if _, err := os.Stat(emptyDir); err != nil {
 		return nil, status.Errorf(codes.Internal, "directory %q for emptyDir %q does not exist", emptyDir, fdPassingEmptyDirName)
 	}
 
 	sockPath := filepath.Join(emptyDir, fdPassingSocketName)
-	if _, err := os.Stat(sockPath); err == nil {
+	if s.fdPassingSocketExists(targetPath) {
 		// Unix domain socket already waits for connection
 		klog.V(4).Infof("NodePublishVolume succeeded on volume %q to target path %q, unix domain socket already exists.", volumeName, targetPath)
 
 		return &csi.NodePublishVolumeResponse{}, nil
 	}
+	if _, err := os.Stat(sockPath); err == nil {
+		// Nobody serves the socket file, e.g. it was left by a previous run of the driver.
+		klog.Warningf("removing stale fd-passing socket %q for target path %q", sockPath, targetPath)
+		if err := os.Remove(sockPath); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to remove stale fd-passing socket %q: %v", sockPath, err)
+		}
+	}
 
 	klog.V(4).Infof("NodePublishVolume attempting mkdir for path %q", targetPath)
 	if err := os.MkdirAll(targetPath, 0o750); err != nil {
@@ -167,6 +216,19 @@ func (s *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublish
 		return nil, status.Errorf(codes.Internal, "failed to mount volume %q to target path %q: %v", volumeName, targetPath, err)
 	}
 
+	// The mount of the previous call may have failed after it returned.
+	// The failure is reported once now that the socket is re-armed.
+	if mountErr := s.takeMountError(targetPath); mountErr != nil {
+		klog.Warningf("mount of volume %q on target path %q failed after NodePublishVolume returned: %v", volumeName, targetPath, mountErr)
+
+		return nil, status.Errorf(codes.Internal, "mount failed: %v. fd-passing socket %q is re-armed for the sidecar to handshake again", mountErr, sockPath)
+	}
+
+	if rearmed {
+		// Report the lost connection to kubelet. The next republish finds the socket waiting and succeeds.
+		return nil, status.Errorf(codes.Unavailable, "FUSE connection of volume %q on target path %q was lost, fd-passing socket %q is re-armed for the sidecar to handshake again", volumeName, targetPath, sockPath)
+	}
+
 	klog.V(4).Infof("NodePublishVolume succeeded on volume %q to target path %q", volumeName, targetPath)
 
 	return &csi.NodePublishVolumeResponse{}, nil
@@ -185,24 +247,21 @@ func (s *nodeServer) NodeUnpublishVolume(_ context.Context, req *csi.NodeUnpubli
 	}
 	defer s.volumeLocks.Release(targetPath)
 
+	// The mount failure not reported by NodePublishVolume is reported once.
+	// kubelet retries NodeUnpublishVolume, which then tears down the volume.
+	if err := s.takeMountError(targetPath); err != nil {
+		return nil, status.Errorf(codes.Internal, "mount failed: %v", err)
+	}
+
 	// Check if the target path is already mounted
 	if mounted, err := s.isDirMounted(targetPath); mounted || err != nil {
 		if err != nil {
 			klog.Errorf("failed to check if path %q is already mounted: %v", targetPath, err)
 		}
-		// Force unmount the target path
-		// Try to do force unmount firstly because if the file descriptor was not closed,
-		// mount.CleanupMountPoint() call will hang.
-		forceUnmounter, ok := s.mounter.(mount.MounterForceUnmounter)
-		if ok {
-			if err = forceUnmounter.UnmountWithForce(targetPath, UmountTimeout); err != nil {
-				return nil, status.Errorf(codes.Internal, "failed to force unmount target path %q: %v", targetPath, err)
-			}
-		} else {
-			klog.Warningf("failed to cast the mounter to a forceUnmounter, proceed with the default mounter Unmount")
-			if err = s.mounter.Unmount(targetPath); err != nil {
-				return nil, status.Errorf(codes.Internal, "failed to unmount target path %q: %v", targetPath, err)
-			}
+		// Let the sidecar flush its data before the mount is gone.
+		s.notifyTeardown(targetPath)
+		if err = s.unmountTarget(targetPath); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
 		}
 	}
 
@@ -227,10 +286,96 @@ func (s *nodeServer) NodeUnpublishVolume(_ context.Context, req *csi.NodeUnpubli
 		return nil, status.Errorf(codes.Internal, "failed to cleanup the mount point %q: %v", targetPath, err)
 	}
 
-	// Checking the fd-passing socket is closed.
-	// If not closed, close it and wait for the acception goroutine exits.
-	// NOTE: The acception goroutine owns FUSE fd, and floated FUSE fd causes hang.
-	//       When the acception goroutine exis, FUSE fd is also closed.
+	s.closeFdPassingSocket(targetPath)
+
+	klog.V(4).Infof("NodeUnpublishVolume succeeded on target path %q", targetPath)
+
+	return &csi.NodeUnpublishVolumeResponse{}, nil
+}
+
+// NodeGetVolumeStats reports the usage of the FUSE filesystem,
+// and the volume condition is abnormal if the mount failed or the FUSE connection is lost.
+func (s *nodeServer) NodeGetVolumeStats(_ context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
+	targetPath := req.GetVolumePath()
+	if len(targetPath) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "NodeGetVolumeStats volume path must be provided")
+	}
+
+	if err := s.mountError(targetPath); err != nil {
+		return &csi.NodeGetVolumeStatsResponse{
+			VolumeCondition: &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("mount failed: %v", err)},
+		}, nil
+	}
+
+	mounted, err := s.isDirMounted(targetPath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to check if path %q is already mounted: %v", targetPath, err)
+	}
+	if !mounted {
+		if _, err := os.Stat(targetPath); err != nil {
+			return nil, status.Errorf(codes.NotFound, "volume path %q does not exist: %v", targetPath, err)
+		}
+		// The sidecar has not received the fd yet.
+		return &csi.NodeGetVolumeStatsResponse{
+			VolumeCondition: &csi.VolumeCondition{Message: "waiting for the sidecar to receive the fd"},
+		}, nil
+	}
+
+	st, err := s.prober.statfs(targetPath)
+	if err != nil {
+		return &csi.NodeGetVolumeStatsResponse{
+			VolumeCondition: &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("FUSE filesystem does not answer: %v", err)},
+		}, nil
+	}
+
+	//nolint:gosec
+	return &csi.NodeGetVolumeStatsResponse{
+		Usage: []*csi.VolumeUsage{
+			{
+				Unit:      csi.VolumeUsage_BYTES,
+				Total:     int64(st.Blocks) * st.Bsize,
+				Available: int64(st.Bavail) * st.Bsize,
+				Used:      int64(st.Blocks-st.Bfree) * st.Bsize,
+			},
+			{
+				Unit:      csi.VolumeUsage_INODES,
+				Total:     int64(st.Files),
+				Available: int64(st.Ffree),
+				Used:      int64(st.Files - st.Ffree),
+			},
+		},
+		VolumeCondition: &csi.VolumeCondition{Message: "FUSE filesystem is mounted"},
+	}, nil
+}
+
+// mountError returns the error of the mount on the target path failed after NodePublishVolume returned.
+func (s *nodeServer) mountError(targetPath string) error {
+	if csiMounter, ok := s.mounter.(*csimounter.Mounter); ok {
+		return csiMounter.FdPassingSockets.MountError(targetPath)
+	}
+
+	return nil
+}
+
+// takeMountError returns the error like mountError and forgets it to allow a retry.
+func (s *nodeServer) takeMountError(targetPath string) error {
+	if csiMounter, ok := s.mounter.(*csimounter.Mounter); ok {
+		return csiMounter.FdPassingSockets.TakeMountError(targetPath)
+	}
+
+	return nil
+}
+
+// fdPassingSocketExists returns true if the fd-passing socket of the target path is served.
+func (s *nodeServer) fdPassingSocketExists(targetPath string) bool {
+	csiMounter, ok := s.mounter.(*csimounter.Mounter)
+	return ok && csiMounter.FdPassingSockets.Exist(targetPath)
+}
+
+// closeFdPassingSocket closes the fd-passing socket of the target path if not closed,
+// and waits for the acception goroutine to exit.
+// The socket is kept open after the handshake to serve requests like unmount from the sidecar.
+func (s *nodeServer) closeFdPassingSocket(targetPath string) {
 	csiMounter, ok := s.mounter.(*csimounter.Mounter)
 	if !ok {
 		klog.Error("failed to cast the mounter to a csimounter.Mounter.")
@@ -245,10 +390,34 @@ func (s *nodeServer) NodeUnpublishVolume(_ context.Context, req *csi.NodeUnpubli
 			klog.V(4).Infof("fd-passing socket for %q is closed.", targetPath)
 		}
 	}
+}
 
-	klog.V(4).Infof("NodeUnpublishVolume succeeded on target path %q", targetPath)
+// notifyTeardown notifies the clients watching the fd-passing socket of the target path that the volume is being torn down.
+// The containers of the Pod have already stopped, so only the clients outside of the Pod can receive it.
+func (s *nodeServer) notifyTeardown(targetPath string) {
+	if csiMounter, ok := s.mounter.(*csimounter.Mounter); ok {
+		csiMounter.FdPassingSockets.Notify(targetPath, starter.EventTeardown)
+	}
+}
 
-	return &csi.NodeUnpublishVolumeResponse{}, nil
+// unmountTarget unmounts the target path.
+func (s *nodeServer) unmountTarget(targetPath string) error {
+	// Force unmount the target path
+	// Try to do force unmount firstly because if the file descriptor was not closed,
+	// mount.CleanupMountPoint() call will hang.
+	forceUnmounter, ok := s.mounter.(mount.MounterForceUnmounter)
+	if ok {
+		if err := forceUnmounter.UnmountWithForce(targetPath, UmountTimeout); err != nil {
+			return fmt.Errorf("failed to force unmount target path %q: %w", targetPath, err)
+		}
+	} else {
+		klog.Warningf("failed to cast the mounter to a forceUnmounter, proceed with the default mounter Unmount")
+		if err := s.mounter.Unmount(targetPath); err != nil {
+			return fmt.Errorf("failed to unmount target path %q: %w", targetPath, err)
+		}
+	}
+
+	return nil
 }
 
 // isDirMounted checks if the path is already a mount point.
@@ -0,0 +1,403 @@
+/*
+Copyright 2023 Preferred Networks, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	csimounter "github.com/pfnet-research/meta-fuse-csi-plugin/pkg/csi_mounter"
+	"github.com/pfnet-research/meta-fuse-csi-plugin/pkg/csi_mounter/fake"
+	starter "github.com/pfnet-research/meta-fuse-csi-plugin/pkg/fuse_starter"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// testNode is a nodeServer mounting on the fake mounter, with the Pod directory of kubelet in a temporary directory.
+type testNode struct {
+	ns         *nodeServer
+	mounter    *csimounter.Mounter
+	sc         *fake.Syscalls
+	targetPath string
+	sockPath   string
+}
+
+func newTestNode(t *testing.T) *testNode {
+	// The socket path must fit in sun_path, so the temporary directory is kept short.
+	dir, err := os.MkdirTemp("", "csi")
+	if err != nil {
+		t.Fatalf("failed to create a temporary directory: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	podDir := filepath.Join(dir, "var/lib/kubelet/pods/pod")
+	emptyDir := filepath.Join(podDir, "volumes/kubernetes.io~empty-dir/fd")
+	if err := os.MkdirAll(emptyDir, 0o750); err != nil {
+		t.Fatalf("failed to create the emptyDir: %v", err)
+	}
+
+	sc := fake.NewSyscalls(fake.NewMounter())
+	m := csimounter.NewWithSyscalls(sc.Mounter, sc)
+	driver, err := NewDriver(&DriverConfig{Name: DefaultName, Version: "test", NodeID: "node", Mounter: m})
+	if err != nil {
+		t.Fatalf("failed to create the driver: %v", err)
+	}
+
+	ns := driver.ns.(*nodeServer)
+	ns.emptyDirPath = func(podID, emptyDirName string) string {
+		return filepath.Join(dir, "var/lib/kubelet/pods", podID, "volumes/kubernetes.io~empty-dir", emptyDirName)
+	}
+
+	return &testNode{
+		ns:         ns,
+		mounter:    m,
+		sc:         sc,
+		targetPath: filepath.Join(podDir, "volumes/kubernetes.io~csi/test-volume/mount"),
+		sockPath:   filepath.Join(emptyDir, "s"),
+	}
+}
+
+func (n *testNode) publishRequest() *csi.NodePublishVolumeRequest {
+	return &csi.NodePublishVolumeRequest{
+		VolumeId:   "test-volume",
+		TargetPath: n.targetPath,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+		VolumeContext: map[string]string{
+			VolumeContextKeyEphemeral:             "true",
+			VolumeContextKeyFdPassingEmptyDirName: "fd",
+			VolumeContextKeyFdPassingSocketName:   "s",
+		},
+	}
+}
+
+// handshake receives the FUSE fd like the sidecar.
+func (n *testNode) handshake(t *testing.T) *starter.MountConfig {
+	mc, err := starter.PrepareMountConfig(n.sockPath, time.Second, nil)
+	if err != nil {
+		t.Fatalf("Did not expect error but got: %v", err)
+	}
+	t.Cleanup(func() { syscall.Close(mc.FileDescriptor) })
+
+	return mc
+}
+
+func TestNodePublishAndUnpublishVolume(t *testing.T) {
+	t.Parallel()
+
+	n := newTestNode(t)
+	ctx := context.Background()
+
+	if _, err := n.ns.NodePublishVolume(ctx, n.publishRequest()); err != nil {
+		t.Fatalf("Did not expect error but got: %v", err)
+	}
+	if !n.mounter.FdPassingSockets.Exist(n.targetPath) {
+		t.Errorf("Expected the fd-passing socket to be served but it is not")
+	}
+	if _, ok := n.sc.MountOptions(n.targetPath); ok {
+		t.Errorf("Expected the target not to be mounted before the handshake")
+	}
+
+	n.handshake(t)
+	if _, ok := n.sc.MountOptions(n.targetPath); !ok {
+		t.Fatalf("Expected the target to be mounted but it is not")
+	}
+
+	// kubelet republishes the volume periodically.
+	if _, err := n.ns.NodePublishVolume(ctx, n.publishRequest()); err != nil {
+		t.Errorf("Did not expect error but got: %v", err)
+	}
+
+	if _, err := n.ns.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: "test-volume", TargetPath: n.targetPath}); err != nil {
+		t.Fatalf("Did not expect error but got: %v", err)
+	}
+	if _, ok := n.sc.MountOptions(n.targetPath); ok {
+		t.Errorf("Expected the target to be unmounted but it is not")
+	}
+	if n.mounter.FdPassingSockets.Exist(n.targetPath) {
+		t.Errorf("Expected the socket to be unregistered but it is not")
+	}
+	if _, err := os.Stat(n.targetPath); !os.IsNotExist(err) {
+		t.Errorf("target path %q is not removed: %v", n.targetPath, err)
+	}
+	if _, err := os.Stat(n.sockPath); !os.IsNotExist(err) {
+		t.Errorf("socket %q is not removed: %v", n.sockPath, err)
+	}
+}
+
+// waitForUnregister waits for the fd-passing socket of the target path to be closed after a failure.
+func (n *testNode) waitForUnregister(t *testing.T) {
+	for i := 0; n.mounter.FdPassingSockets.Exist(n.targetPath); i++ {
+		if i > 100 {
+			t.Fatalf("fd-passing socket for %q is not unregistered", n.targetPath)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNodePublishVolumeRearmsLostConnection(t *testing.T) {
+	t.Parallel()
+
+	n := newTestNode(t)
+	ctx := context.Background()
+
+	if _, err := n.ns.NodePublishVolume(ctx, n.publishRequest()); err != nil {
+		t.Fatalf("Did not expect error but got: %v", err)
+	}
+	first := n.handshake(t)
+
+	// The sidecar died and the kernel reports the lost FUSE connection.
+	n.ns.prober.statFunc = func(_ string) error {
+		return syscall.ENOTCONN
+	}
+	_, err := n.ns.NodePublishVolume(ctx, n.publishRequest())
+	if code := status.Code(err); code != codes.Unavailable {
+		t.Errorf("Got code %v, but expected %v: %v", code, codes.Unavailable, err)
+	}
+	if _, ok := n.sc.MountOptions(n.targetPath); ok {
+		t.Errorf("Expected the dead mount to be detached but it is not")
+	}
+	if !n.mounter.FdPassingSockets.Exist(n.targetPath) {
+		t.Fatalf("Expected the fd-passing socket to be re-armed but it is not")
+	}
+
+	// The restarted sidecar handshakes again.
+	n.ns.prober.statFunc = func(_ string) error {
+		return nil
+	}
+	second := n.handshake(t)
+	if second.Token == first.Token {
+		t.Errorf("Expected a new token but got the same one")
+	}
+	if _, err := n.ns.NodePublishVolume(ctx, n.publishRequest()); err != nil {
+		t.Errorf("Did not expect error but got: %v", err)
+	}
+
+	if _, err := n.ns.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: "test-volume", TargetPath: n.targetPath}); err != nil {
+		t.Errorf("Did not expect error but got: %v", err)
+	}
+}
+
+func TestNodePublishVolumeReportsMountFailure(t *testing.T) {
+	t.Parallel()
+
+	n := newTestNode(t)
+	ctx := context.Background()
+
+	n.sc.MountErr = syscall.EPERM
+	if _, err := n.ns.NodePublishVolume(ctx, n.publishRequest()); err != nil {
+		t.Fatalf("Did not expect error but got: %v", err)
+	}
+	if _, err := starter.PrepareMountConfig(n.sockPath, time.Second, nil); !errors.Is(err, starter.ErrRefused) {
+		t.Errorf("Got error %v, but expected %v", err, starter.ErrRefused)
+	}
+	n.waitForUnregister(t)
+
+	// The failure is seen by NodeGetVolumeStats until it is reported by NodePublishVolume.
+	resp, err := n.ns.NodeGetVolumeStats(ctx, &csi.NodeGetVolumeStatsRequest{VolumeId: "test-volume", VolumePath: n.targetPath})
+	if err != nil {
+		t.Fatalf("Did not expect error but got: %v", err)
+	}
+	if !resp.GetVolumeCondition().GetAbnormal() {
+		t.Errorf("Got condition %v, but expected abnormal", resp.GetVolumeCondition())
+	}
+
+	// The failure is kept when NodePublishVolume fails before re-arming the socket.
+	emptyDirPath := n.ns.emptyDirPath
+	n.ns.emptyDirPath = func(_, _ string) string {
+		return filepath.Join(n.targetPath, "missing")
+	}
+	if _, err := n.ns.NodePublishVolume(ctx, n.publishRequest()); err == nil || strings.Contains(err.Error(), "mount failed") {
+		t.Errorf("Got error %v, but expected the missing emptyDir", err)
+	}
+	n.ns.emptyDirPath = emptyDirPath
+
+	n.sc.MountErr = nil
+	_, err = n.ns.NodePublishVolume(ctx, n.publishRequest())
+	if code := status.Code(err); code != codes.Internal || !strings.Contains(err.Error(), "operation not permitted") {
+		t.Errorf("Got error %v, but expected %v with the mount failure", err, codes.Internal)
+	}
+	if !n.mounter.FdPassingSockets.Exist(n.targetPath) {
+		t.Fatalf("Expected the fd-passing socket to be re-armed but it is not")
+	}
+
+	// The failure is reported once, and the sidecar can retry.
+	n.handshake(t)
+	if _, err := n.ns.NodePublishVolume(ctx, n.publishRequest()); err != nil {
+		t.Errorf("Did not expect error but got: %v", err)
+	}
+
+	if _, err := n.ns.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: "test-volume", TargetPath: n.targetPath}); err != nil {
+		t.Errorf("Did not expect error but got: %v", err)
+	}
+}
+
+func TestNodeUnpublishVolumeReportsMountFailure(t *testing.T) {
+	t.Parallel()
+
+	n := newTestNode(t)
+	ctx := context.Background()
+
+	n.sc.MountErr = syscall.EPERM
+	if _, err := n.ns.NodePublishVolume(ctx, n.publishRequest()); err != nil {
+		t.Fatalf("Did not expect error but got: %v", err)
+	}
+	if _, err := starter.PrepareMountConfig(n.sockPath, time.Second, nil); !errors.Is(err, starter.ErrRefused) {
+		t.Errorf("Got error %v, but expected %v", err, starter.ErrRefused)
+	}
+	n.waitForUnregister(t)
+
+	// The failure is reported once, and the retry tears down the volume.
+	req := &csi.NodeUnpublishVolumeRequest{VolumeId: "test-volume", TargetPath: n.targetPath}
+	_, err := n.ns.NodeUnpublishVolume(ctx, req)
+	if code := status.Code(err); code != codes.Internal || !strings.Contains(err.Error(), "operation not permitted") {
+		t.Errorf("Got error %v, but expected %v with the mount failure", err, codes.Internal)
+	}
+	if _, err := n.ns.NodeUnpublishVolume(ctx, req); err != nil {
+		t.Errorf("Did not expect error but got: %v", err)
+	}
+	if _, err := os.Stat(n.targetPath); !os.IsNotExist(err) {
+		t.Errorf("target path %q is not removed: %v", n.targetPath, err)
+	}
+}
+
+func TestNodeGetCapabilities(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name                 string
+		enableVolumeStats    bool
+		expectedCapabilities int
+	}{
+		{
+			name: "should not advertise volume stats by default",
+		},
+		{
+			name:                 "should advertise volume stats and condition if enabled",
+			enableVolumeStats:    true,
+			expectedCapabilities: 2,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+
+		driver, err := NewDriver(&DriverConfig{Name: DefaultName, Version: "test", NodeID: "node", EnableVolumeStats: tc.enableVolumeStats})
+		if err != nil {
+			t.Fatalf("Did not expect error but got: %v", err)
+		}
+		resp, err := driver.ns.NodeGetCapabilities(context.Background(), &csi.NodeGetCapabilitiesRequest{})
+		if err != nil {
+			t.Errorf("Did not expect error but got: %v", err)
+
+			continue
+		}
+		if n := len(resp.GetCapabilities()); n != tc.expectedCapabilities {
+			t.Errorf("Got %d capabilities, but expected %d", n, tc.expectedCapabilities)
+		}
+	}
+}
+
+func TestNodeGetVolumeStats(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name              string
+		publish           bool
+		handshake         bool
+		statfsErr         error
+		expectedCode      codes.Code
+		expectedAbnormal  bool
+		expectedMessage   string
+		expectedUsageSize int
+	}{
+		{
+			name:         "should return NotFound for the volume not published",
+			expectedCode: codes.NotFound,
+		},
+		{
+			name:            "should wait for the sidecar before the handshake",
+			publish:         true,
+			expectedMessage: "waiting for the sidecar to receive the fd",
+		},
+		{
+			name:              "should report the usage of the mounted filesystem",
+			publish:           true,
+			handshake:         true,
+			expectedMessage:   "FUSE filesystem is mounted",
+			expectedUsageSize: 2,
+		},
+		{
+			name:             "should report abnormal when the FUSE filesystem does not answer",
+			publish:          true,
+			handshake:        true,
+			statfsErr:        syscall.ENOTCONN,
+			expectedAbnormal: true,
+			expectedMessage:  "FUSE filesystem does not answer",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+
+		n := newTestNode(t)
+		ctx := context.Background()
+		n.ns.prober.statfsFunc = func(path string, st *syscall.Statfs_t) error {
+			if tc.statfsErr != nil {
+				return tc.statfsErr
+			}
+			return syscall.Statfs(path, st)
+		}
+		if tc.publish {
+			if _, err := n.ns.NodePublishVolume(ctx, n.publishRequest()); err != nil {
+				t.Fatalf("Did not expect error but got: %v", err)
+			}
+		}
+		if tc.handshake {
+			n.handshake(t)
+		}
+
+		resp, err := n.ns.NodeGetVolumeStats(ctx, &csi.NodeGetVolumeStatsRequest{VolumeId: "test-volume", VolumePath: n.targetPath})
+		if code := status.Code(err); code != tc.expectedCode {
+			t.Errorf("Got code %v, but expected %v: %v", code, tc.expectedCode, err)
+		}
+		if err == nil {
+			condition := resp.GetVolumeCondition()
+			if condition.GetAbnormal() != tc.expectedAbnormal || !strings.Contains(condition.GetMessage(), tc.expectedMessage) {
+				t.Errorf("Got condition %v, but expected abnormal=%v with %q", condition, tc.expectedAbnormal, tc.expectedMessage)
+			}
+			if len(resp.GetUsage()) != tc.expectedUsageSize {
+				t.Errorf("Got usage %v, but expected %d entries", resp.GetUsage(), tc.expectedUsageSize)
+			}
+		}
+
+		if tc.publish {
+			if err := n.mounter.FdPassingSockets.CloseAndUnregister(n.targetPath, true); err != nil {
+				t.Errorf("Did not expect error but got: %v", err)
+			}
+			n.mounter.FdPassingSockets.WaitForExit(n.targetPath)
+		}
+	}
+}
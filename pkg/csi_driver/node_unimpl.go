@@ -33,10 +33,6 @@ func (s *nodeServer) NodeUnstageVolume(_ context.Context, _ *csi.NodeUnstageVolu
 	return nil, status.Error(codes.Unimplemented, "NodeUnstageVolumeResponse unsupported")
 }
 
-func (s *nodeServer) NodeGetVolumeStats(_ context.Context, _ *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "NodeGetVolumeStats unsupported")
-}
-
 func (s *nodeServer) NodeExpandVolume(_ context.Context, _ *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
 	return nil, status.Error(codes.Unimplemented, "NodeUnStageVolume unsupported")
 }
@@ -19,14 +19,21 @@ limitations under the License.
 package csimounter
 
 import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	starter "github.com/pfnet-research/meta-fuse-csi-plugin/pkg/fuse_starter"
 	"github.com/pfnet-research/meta-fuse-csi-plugin/pkg/util"
@@ -39,14 +46,33 @@ const (
 	// See the nonroot user discussion: https://github.com/GoogleContainerTools/distroless/issues/443
 	NobodyUID = 65534
 	NobodyGID = 65534
+
+	// LegacyClientTimeout is how long to wait for the first byte of the request of a client after it connected.
+	// A client sending nothing until then is taken as a legacy client waiting for the FUSE fd.
+	LegacyClientTimeout = time.Millisecond * 500
+	// RequestTimeout is how long to wait for the rest of the request once the client started sending it.
+	RequestTimeout = time.Second * 5
+	// UnmountTimeout is the timeout of the forced unmount requested by a client.
+	UnmountTimeout = time.Second * 5
+	// NotificationTimeout is how long to wait for writing a notification to a client.
+	NotificationTimeout = time.Second
+
+	// AllowRemountOption is passed to Mount to serve RequestOpRemount on the fd-passing socket.
+	// It is not passed to mount(8).
+	AllowRemountOption = "allow-remount"
 )
 
 // Mounter provides the meta-fuse-csi-plugin implementation of mount.Interface
 // for the linux platform.
 type Mounter struct {
 	mount.MounterForceUnmounter
-	chdirMu          sync.Mutex
 	FdPassingSockets *FdPassingSockets
+	// Syscalls opens /dev/fuse and mounts the FUSE filesystems served by the fd-passing sockets.
+	Syscalls Syscalls
+	// CheckConnection checks whether the FUSE daemon still serves the mount on a target path, giving up on a hung daemon.
+	// A mount request on a target whose FUSE connection is lost replaces the dead mount, so that a restarted client can mount it again.
+	// Mount requests on a mounted target are refused if it is nil.
+	CheckConnection func(target string) error
 }
 
 // New returns a mount.MounterForceUnmounter for the current system.
@@ -59,12 +85,22 @@ func New(mounterPath string) (mount.Interface, error) {
 	}
 
 	return &Mounter{
-		m,
-		sync.Mutex{},
-		newFdPassingSockets(),
+		MounterForceUnmounter: m,
+		FdPassingSockets:      newFdPassingSockets(),
+		Syscalls:              &linuxSyscalls{mounter: m},
 	}, nil
 }
 
+// NewWithSyscalls returns a Mounter providing mount.Interface with m and serving the fd-passing sockets with sc,
+// like fake.Mounter and fake.Syscalls sharing the mounts.
+func NewWithSyscalls(m mount.MounterForceUnmounter, sc Syscalls) *Mounter {
+	return &Mounter{
+		MounterForceUnmounter: m,
+		FdPassingSockets:      newFdPassingSockets(),
+		Syscalls:              sc,
+	}
+}
+
 func (m *Mounter) Mount(source string, target string, fstype string, options []string) error {
 	if len(options) == 1 {
 		options = append(options, "")
@@ -77,6 +113,7 @@ func (m *Mounter) Mount(source string, target string, fstype string, options []s
 	options = options[1:]
 
 	csiMountOptions, _ := prepareMountOptions(options[1:])
+	allowRemount := sets.NewString(options...).Has(AllowRemountOption)
 
 	klog.V(4).Info("passing the descriptor")
 
@@ -88,117 +125,582 @@ func (m *Mounter) Mount(source string, target string, fstype string, options []s
 	// Prepare sidecar mounter MountConfig
 	mc := starter.MountConfig{
 		VolumeName: source,
+		MountPoint: target,
 	}
-	mcb, err := json.Marshal(mc)
-	if err != nil {
-		return fmt.Errorf("failed to marshal sidecar mounter MountConfig %v: %w", mc, err)
+
+	podID, volumeName, _ := util.ParsePodIDVolumeFromTargetpath(target)
+	session := &fdPassingSession{
+		mounter:         m,
+		target:          target,
+		fstype:          fstype,
+		csiMountOptions: csiMountOptions,
+		allowRemount:    allowRemount,
+		volumeName:      volumeName,
+		mc:              mc,
+		logPrefix:       fmt.Sprintf("[Pod %v, VolumeName %v]", podID, volumeName),
 	}
 
+	m.FdPassingSockets.attach(target, session)
+
 	// Asynchronously waiting for the sidecar container to connect to the listener
-	go func(mounter *Mounter, target, fstype string, csiMountOptions []string, msg []byte) {
-		defer func() {
-			err = mounter.FdPassingSockets.CloseAndUnregister(target, false)
-			if err != nil {
-				klog.Errorf("failed to close and unregister fd-passing socket for %q: %w", target, err)
-			}
-		}()
+	go session.serve()
 
-		podID, volumeName, _ := util.ParsePodIDVolumeFromTargetpath(target)
-		logPrefix := fmt.Sprintf("[Pod %v, VolumeName %v]", podID, volumeName)
+	return nil
+}
 
-		klog.V(4).Infof("%v start to accept connections to the listener.", logPrefix)
-		a, err := mounter.FdPassingSockets.accept(target)
-		if err != nil {
-			klog.Errorf("%v failed to accept connections to the listener: %v", logPrefix, err)
-			return
+// fdPassingSession serves requests on the fd-passing socket of a target until the socket is closed.
+type fdPassingSession struct {
+	mounter         *Mounter
+	target          string
+	fstype          string
+	csiMountOptions []string
+	// allowRemount enables RequestOpRemount, which breaks the mount seen by the containers without HostToContainer propagation.
+	allowRemount bool
+	volumeName   string
+	// mc is the MountConfig sent to the client without the token.
+	mc        starter.MountConfig
+	logPrefix string
+
+	// mu guards the fields below, which are also accessed on notifications.
+	mu sync.Mutex
+	// token is handed to the client with the FUSE fd.
+	// It is empty while the target is not mounted via the socket.
+	token string
+	// report is the last state of the FUSE daemon reported by the client.
+	report     *starter.Report
+	reportedAt time.Time
+	// watchers are the connections of RequestOpWatch receiving notifications.
+	watchers []net.Conn
+}
+
+func (s *fdPassingSession) serve() {
+	// mountErr is the error which stopped serving the socket.
+	var mountErr error
+	defer func() {
+		s.mu.Lock()
+		for _, c := range s.watchers {
+			c.Close()
 		}
-		defer a.Close()
+		s.watchers = nil
+		s.mu.Unlock()
+		if err := s.mounter.FdPassingSockets.unregisterWithError(s.target, mountErr); err != nil {
+			klog.Errorf("failed to close and unregister fd-passing socket for %q: %v", s.target, err)
+		}
+	}()
 
-		klog.V(4).Info("opening the device /dev/fuse")
-		fuseFd, err := syscall.Open("/dev/fuse", syscall.O_RDWR, 0o644)
+	for {
+		klog.V(4).Infof("%v start to accept connections to the listener.", s.logPrefix)
+		conn, err := s.mounter.FdPassingSockets.accept(s.target)
 		if err != nil {
-			klog.Errorf("failed to open the device /dev/fuse: %w", err)
-			return
+			if errors.Is(err, net.ErrClosed) {
+				klog.V(4).Infof("%v the listener is closed.", s.logPrefix)
+			} else {
+				klog.Errorf("%v failed to accept connections to the listener: %v", s.logPrefix, err)
+			}
+			break
 		}
-		defer syscall.Close(fuseFd)
-		csiMountOptions = append(csiMountOptions, fmt.Sprintf("fd=%v", fuseFd))
 
-		// fuse-impl expects fuse is mounted.
-		klog.V(4).Info("mounting the fuse filesystem")
-		err = mounter.MountSensitiveWithoutSystemdWithMountFlags(volumeName, target, fstype, csiMountOptions, nil, []string{"--internal-only"})
+		if err := s.handle(conn); err != nil {
+			// Close the socket so that NodePublishVolume creates it again.
+			// The error is reported by the next CSI call on the target.
+			klog.Errorf("%v %v", s.logPrefix, err)
+			mountErr = err
+			break
+		}
+	}
+
+	klog.V(4).Infof("%v exiting the goroutine.", s.logPrefix)
+}
+
+// handle serves a request on conn. It returns an error when the socket cannot serve requests anymore.
+// conn is closed after the request is served, except for RequestOpWatch.
+func (s *fdPassingSession) handle(conn net.Conn) error {
+	req, err := readRequest(conn, LegacyClientTimeout, RequestTimeout)
+	if err != nil {
+		conn.Close()
+		klog.Warningf("%v failed to read the request: %v", s.logPrefix, err)
+		return nil
+	}
+	if req.Op == starter.RequestOpWatch {
+		s.watch(conn, req)
+		return nil
+	}
+	defer conn.Close()
+
+	switch req.Op {
+	case starter.RequestOpMount:
+		if err := s.unmountIfConnectionLost(); err != nil {
+			klog.Warningf("%v refused the mount request: %v", s.logPrefix, err)
+			writeResponse(conn, starter.Response{Error: err.Error()})
+			return nil
+		}
+		return s.handleMount(conn, req)
+	case starter.RequestOpUnmount:
+		resp := starter.Response{}
+		if err := s.unmount(req); err != nil {
+			klog.Warningf("%v refused the unmount request: %v", s.logPrefix, err)
+			resp.Error = err.Error()
+		} else {
+			klog.Infof("%v unmounted %q on request (lazy=%v)", s.logPrefix, s.target, req.Lazy)
+		}
+		writeResponse(conn, resp)
+		return nil
+	case starter.RequestOpRemount:
+		if !s.allowRemount {
+			klog.Warningf("%v refused the remount request: remount is not allowed on the volume", s.logPrefix)
+			writeResponse(conn, starter.Response{Error: "remount is not allowed on the volume. It requires the volume attribute \"allowRemount\" and mountPropagation HostToContainer on the volume mounts"})
+			return nil
+		}
+		if err := s.unmount(starter.Request{Token: req.Token}); err != nil {
+			klog.Warningf("%v refused the remount request: %v", s.logPrefix, err)
+			writeResponse(conn, starter.Response{Error: err.Error()})
+			return nil
+		}
+		klog.Infof("%v unmounted %q to remount on request", s.logPrefix, s.target)
+		return s.handleMount(conn, req)
+	case starter.RequestOpStatus:
+		status, err := s.status(req.Token)
 		if err != nil {
-			klog.Errorf("failed to mount the fuse filesystem: %w", err)
-			return
+			klog.Warningf("%v refused the status request: %v", s.logPrefix, err)
+			writeResponse(conn, starter.Response{Error: err.Error()})
+			return nil
 		}
+		writeResponse(conn, starter.Response{Status: status})
+		return nil
+	case starter.RequestOpReport:
+		resp := starter.Response{}
+		if err := s.storeReport(req); err != nil {
+			klog.Warningf("%v refused the report: %v", s.logPrefix, err)
+			resp.Error = err.Error()
+		}
+		writeResponse(conn, resp)
+		return nil
+	default:
+		klog.Warningf("%v got unknown request %q", s.logPrefix, req.Op)
+		writeResponse(conn, starter.Response{Error: fmt.Sprintf("unknown request %q", req.Op)})
+		return nil
+	}
+}
 
-		klog.V(4).Infof("%v start to send file descriptor and mount options", logPrefix)
-		if err = util.SendMsg(a, fuseFd, msg); err != nil {
-			klog.Errorf("%v failed to send file descriptor and mount options: %v", logPrefix, err)
-			return
+// handleMount mounts the target with the options of req and sends the FUSE fd to the client.
+func (s *fdPassingSession) handleMount(conn net.Conn, req starter.Request) error {
+	source, fstype, options, err := s.mountArgs(req.Options)
+	if err != nil {
+		// The client may retry with other options.
+		klog.Warningf("%v refused the %s request: %v", s.logPrefix, req.Op, err)
+		writeResponse(conn, starter.Response{Error: err.Error()})
+		return nil
+	}
+	if err := s.mount(conn, source, fstype, options); err != nil {
+		writeResponse(conn, starter.Response{Error: err.Error()})
+		return err
+	}
+
+	return nil
+}
+
+// mountArgs returns the source, the filesystem type and the options to mount the target
+// with the mount options requested by the client applied.
+// Options the CSI driver enforces, like "nosuid", are accepted as is.
+// "rw" is ignored on a read-only volume like fusermount3 of the kernel, since libfuse3 requests it unless "ro" is specified.
+// It returns an error for options which weaken the CSI driver, like "suid" and "user_id=", and drops the other unknown ones.
+func (s *fdPassingSession) mountArgs(requested []string) (string, string, []string, error) {
+	source := s.volumeName
+	fstype := s.fstype
+	options := append([]string{}, s.csiMountOptions...)
+	readOnly := sets.NewString(options...).Has("ro")
+
+	for _, o := range requested {
+		name, value, hasValue := strings.Cut(o, "=")
+		switch {
+		case o == "" || enforcedMountOptions[o]:
+		case o == "ro":
+			if !readOnly {
+				options = append(sets.NewString(options...).Delete("rw").List(), "ro")
+				readOnly = true
+			}
+		case o == "rw":
+			// The volume is read-write unless it is read-only, and "ro" of the volume wins.
+		case allowedMountOptions[o]:
+			options = append(options, o)
+		case hasValue && name == "fsname":
+			// The source and the type are arguments of mount(8) running as root.
+			if err := starter.ValidateFsname(value); err != nil {
+				return "", "", nil, fmt.Errorf("option %q is invalid: %w", o, err)
+			}
+			source = value
+		case hasValue && name == "subtype":
+			if err := starter.ValidateSubtype(value); err != nil {
+				return "", "", nil, fmt.Errorf("option %q is invalid: %w", o, err)
+			}
+			fstype = fmt.Sprintf("%s.%s", s.fstype, value)
+		case hasValue && name == "max_read":
+			if _, err := strconv.ParseUint(value, 10, 32); err != nil {
+				return "", "", nil, fmt.Errorf("option %q has an invalid value", o)
+			}
+			options = append(options, o)
+		case refusedMountOptions[o] || (hasValue && refusedMountOptions[name+"="]):
+			return "", "", nil, fmt.Errorf("option %q is not allowed", o)
+		default:
+			// Options like "x-*" and "context=" are not for the FUSE filesystem.
+			klog.Warningf("%v dropped unknown mount option %q", s.logPrefix, o)
 		}
+	}
 
-		klog.V(4).Infof("%v exiting the goroutine.", logPrefix)
-	}(m, target, fstype, csiMountOptions, mcb)
+	return source, fstype, options, nil
+}
+
+func (s *fdPassingSession) mount(conn net.Conn, source, fstype string, options []string) error {
+	klog.V(4).Info("opening the device /dev/fuse")
+	fuseFd, err := s.mounter.Syscalls.OpenFuseDevice()
+	if err != nil {
+		return fmt.Errorf("failed to open the device /dev/fuse: %w", err)
+	}
+	// The FUSE fd is closed after it is sent, so that the FUSE connection is aborted when the client exits.
+	defer syscall.Close(fuseFd)
+	options = append(options, fmt.Sprintf("fd=%v", fuseFd))
+
+	// fuse-impl expects fuse is mounted.
+	klog.V(4).Info("mounting the fuse filesystem")
+	err = s.mounter.Syscalls.Mount(source, s.target, fstype, options)
+	if err != nil {
+		return fmt.Errorf("failed to mount the fuse filesystem: %w", err)
+	}
+
+	token, err := newToken()
+	if err != nil {
+		return err
+	}
+	mc := s.mc
+	mc.Token = token
+	msg, err := json.Marshal(mc)
+	if err != nil {
+		return fmt.Errorf("failed to marshal sidecar mounter MountConfig %v: %w", mc, err)
+	}
+
+	klog.V(4).Infof("%v start to send file descriptor and mount options", s.logPrefix)
+	if err = util.SendMsg(conn, fuseFd, msg); err != nil {
+		return fmt.Errorf("failed to send file descriptor and mount options: %w", err)
+	}
+	s.mu.Lock()
+	s.token = token
+	s.mu.Unlock()
 
 	return nil
 }
 
-func (m *Mounter) createAndRegisterFdPassingSocket(target, sockDir, sockName string) error {
-	m.chdirMu.Lock()
-	defer m.chdirMu.Unlock()
+// authenticate checks token is the one handed to the client with the FUSE fd. The caller must hold s.mu.
+func (s *fdPassingSession) authenticate(token string) error {
+	if s.token == "" {
+		return fmt.Errorf("target is not mounted via the fd-passing socket")
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+		return fmt.Errorf("token does not match the one of the mount")
+	}
 
-	// Need to change the current working directory to the temp volume base path,
-	// because the socket absolute path is longer than 104 characters,
-	// which will cause "bind: invalid argument" errors.
-	exPwd, err := os.Getwd()
+	return nil
+}
+
+func (s *fdPassingSession) unmount(req starter.Request) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.authenticate(req.Token); err != nil {
+		return err
+	}
+
+	if err := s.mounter.Syscalls.Unmount(s.target, req.Lazy, UnmountTimeout); err != nil {
+		if req.Lazy {
+			return fmt.Errorf("failed to lazily unmount: %w", err)
+		}
+		return fmt.Errorf("failed to force unmount: %w", err)
+	}
+	// The client may mount the target again.
+	s.token = ""
+	s.report = nil
+
+	return nil
+}
+
+// unmountIfConnectionLost unmounts the target if the FUSE connection of the mount is lost, e.g. the client was restarted.
+// It returns an error if the target is mounted and served.
+func (s *fdPassingSession) unmountIfConnectionLost() error {
+	s.mu.Lock()
+	mounted := s.token != ""
+	s.mu.Unlock()
+	if !mounted {
+		return nil
+	}
+	if s.mounter.CheckConnection == nil {
+		return fmt.Errorf("target is already mounted")
+	}
+	// The check may block up to its timeout, so s.mu is not held.
+	err := s.mounter.CheckConnection(s.target)
+	if !IsConnectionLost(err) {
+		return fmt.Errorf("target is already mounted")
+	}
+
+	klog.Warningf("%v FUSE connection on %q is lost (%v), unmounting it to mount again", s.logPrefix, s.target, err)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.mounter.Syscalls.Unmount(s.target, true, UnmountTimeout); err != nil {
+		return fmt.Errorf("failed to lazily unmount the dead mount: %w", err)
+	}
+	s.token = ""
+	s.report = nil
+
+	return nil
+}
+
+// IsConnectionLost returns true if err shows the FUSE connection was aborted
+// or no daemon holds the FUSE fd anymore.
+func IsConnectionLost(err error) bool {
+	return errors.Is(err, syscall.ENOTCONN) || errors.Is(err, syscall.ECONNABORTED)
+}
+
+func (s *fdPassingSession) status(token string) (*starter.MountStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.authenticate(token); err != nil {
+		return nil, err
+	}
+
+	status := &starter.MountStatus{
+		Mounted:    true,
+		VolumeName: s.mc.VolumeName,
+		MountPoint: s.mc.MountPoint,
+		Report:     s.report,
+	}
+	if s.report != nil {
+		reportedAt := s.reportedAt
+		status.ReportedAt = &reportedAt
+	}
+
+	return status, nil
+}
+
+func (s *fdPassingSession) storeReport(req starter.Request) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.authenticate(req.Token); err != nil {
+		return err
+	}
+	if req.Report == nil {
+		return fmt.Errorf("report is not specified")
+	}
+
+	if s.report == nil || *s.report != *req.Report {
+		klog.Infof("%v client reported ready=%v healthy=%v: %s", s.logPrefix, req.Report.Ready, req.Report.Healthy, req.Report.Message)
+	}
+	s.report = req.Report
+	s.reportedAt = time.Now()
+
+	return nil
+}
+
+// watch keeps conn open to send notifications if the client is authenticated.
+func (s *fdPassingSession) watch(conn net.Conn, req starter.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.authenticate(req.Token); err != nil {
+		klog.Warningf("%v refused the watch request: %v", s.logPrefix, err)
+		writeResponse(conn, starter.Response{Error: err.Error()})
+		conn.Close()
+		return
+	}
+
+	writeResponse(conn, starter.Response{})
+	s.watchers = append(s.watchers, conn)
+}
+
+// notify sends event to the watching clients, waiting up to timeout for each write.
+// A client failing to receive it stops watching.
+func (s *fdPassingSession) notify(event starter.Event, timeout time.Duration) {
+	s.mu.Lock()
+	watchers := append([]net.Conn{}, s.watchers...)
+	s.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, c := range watchers {
+		wg.Add(1)
+		go func(c net.Conn) {
+			defer wg.Done()
+			if err := sendNotification(c, starter.Notification{Event: event}, timeout); err != nil {
+				klog.Warningf("%v failed to notify %s: %v", s.logPrefix, event, err)
+				s.removeWatcher(c)
+			}
+		}(c)
+	}
+	wg.Wait()
+}
+
+func (s *fdPassingSession) removeWatcher(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	conn.Close()
+	for i, c := range s.watchers {
+		if c == conn {
+			s.watchers = append(s.watchers[:i], s.watchers[i+1:]...)
+			break
+		}
+	}
+}
+
+// sendNotification writes n on conn without waiting for the client to handle it.
+func sendNotification(conn net.Conn, n starter.Notification, timeout time.Duration) error {
+	if err := conn.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	b, err := json.Marshal(n)
 	if err != nil {
-		return fmt.Errorf("failed to get the current directory to %w", err)
+		return err
 	}
-	if err = os.Chdir(sockDir); err != nil {
-		return fmt.Errorf("failed to change directory to %q: %w", sockDir, err)
+	if _, err := conn.Write(b); err != nil {
+		return err
 	}
 
+	return conn.SetWriteDeadline(time.Time{})
+}
+
+// readRequest reads the request which the client sends first on the connection.
+// The client must start sending it within legacyTimeout, and finish within timeout after that.
+func readRequest(conn net.Conn, legacyTimeout, timeout time.Duration) (starter.Request, error) {
+	req := starter.Request{}
+	if err := conn.SetReadDeadline(time.Now().Add(legacyTimeout)); err != nil {
+		return req, err
+	}
+	r := &requestReader{conn: conn, timeout: timeout}
+	err := json.NewDecoder(r).Decode(&req)
+	if (errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, io.EOF)) && r.n == 0 {
+		// Clients before requests were introduced wait for the FUSE fd without sending a request.
+		klog.Warningf("client sent no request within %v, assuming a legacy client waiting for the FUSE fd", legacyTimeout)
+		return starter.Request{Op: starter.RequestOpMount}, nil
+	}
+	if err != nil {
+		return req, err
+	}
+
+	return req, conn.SetReadDeadline(time.Time{})
+}
+
+// requestReader reads the request from conn, and extends the read deadline by timeout when the first byte arrived.
+type requestReader struct {
+	conn    net.Conn
+	timeout time.Duration
+	n       int
+}
+
+func (r *requestReader) Read(p []byte) (int, error) {
+	n, err := r.conn.Read(p)
+	if r.n == 0 && n > 0 {
+		if err := r.conn.SetReadDeadline(time.Now().Add(r.timeout)); err != nil {
+			return n, err
+		}
+	}
+	r.n += n
+
+	return n, err
+}
+
+func writeResponse(conn net.Conn, resp starter.Response) {
+	b, err := json.Marshal(resp)
+	if err == nil {
+		_, err = conn.Write(b)
+	}
+	if err != nil {
+		klog.Warningf("failed to write the response: %v", err)
+	}
+}
+
+// newToken returns a random token authenticating requests of the client which received the FUSE fd.
+func newToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate a token: %w", err)
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+func (m *Mounter) createAndRegisterFdPassingSocket(target, sockDir, sockName string) error {
+	// The socket absolute path can be longer than 108 characters (the size of sun_path),
+	// which will cause "bind: invalid argument" errors.
+	// To keep the bound path short, bind the socket via /proc/self/fd/<dirfd>
+	// instead of changing the current working directory of the whole process.
+	dir, err := os.Open(sockDir)
+	if err != nil {
+		return fmt.Errorf("failed to open directory %q: %w", sockDir, err)
+	}
+	defer dir.Close()
+
 	klog.V(4).Infof("creating a listener for the socket at %q", sockDir)
-	l, err := net.Listen("unix", sockName)
+	l, err := net.Listen("unix", filepath.Join(fmt.Sprintf("/proc/self/fd/%d", dir.Fd()), sockName))
 	if err != nil {
 		return fmt.Errorf("failed to create the listener for the socket: %w", err)
 	}
 
 	unixListner := l.(*net.UnixListener)
+	// The bound path is invalid once dir is closed.
+	// The socket is unlinked by its absolute path in CloseAndUnregister instead.
+	unixListner.SetUnlinkOnClose(false)
+
+	sockPath := filepath.Join(sockDir, sockName)
+	closeListener := func() {
+		l.Close()
+		syscall.Unlink(sockPath)
+	}
 
 	// Change the socket ownership
-	err = os.Chown(sockDir, NobodyUID, NobodyGID)
+	err = m.Syscalls.Chown(sockDir, NobodyUID, NobodyGID)
 	if err != nil {
+		closeListener()
 		return fmt.Errorf("failed to change ownership on emptyDirBasePath: %w", err)
 	}
-	err = os.Chown(sockName, NobodyUID, NobodyGID)
+	err = m.Syscalls.Chown(sockPath, NobodyUID, NobodyGID)
 	if err != nil {
+		closeListener()
 		return fmt.Errorf("failed to change ownership on socket: %w", err)
 	}
 
-	if err = os.Chdir(exPwd); err != nil {
-		return fmt.Errorf("failed to change directory to %q: %w", exPwd, err)
-	}
-
-	sockPath := filepath.Join(sockDir, sockName)
 	if err = m.FdPassingSockets.register(target, sockPath, unixListner); err != nil {
+		closeListener()
 		return fmt.Errorf("failed to register socket at %q: %w", sockPath, err)
 	}
 
 	return nil
 }
 
-func prepareMountOptions(options []string) ([]string, []string) {
-	allowedOptions := map[string]bool{
-		"exec":    true,
-		"noexec":  true,
-		"atime":   true,
-		"noatime": true,
-		"sync":    true,
-		"async":   true,
-		"dirsync": true,
-	}
+// allowedMountOptions are the mount options users and clients can specify.
+var allowedMountOptions = map[string]bool{
+	"exec":    true,
+	"noexec":  true,
+	"atime":   true,
+	"noatime": true,
+	"sync":    true,
+	"async":   true,
+	"dirsync": true,
+}
+
+// enforcedMountOptions are always specified by the CSI driver. Clients like libfuse3 may request them as well.
+var enforcedMountOptions = map[string]bool{
+	"nodev":               true,
+	"nosuid":              true,
+	"allow_other":         true,
+	"default_permissions": true,
+}
 
+// refusedMountOptions are the mount options clients cannot specify, since they override the ones of the CSI driver.
+// Options with a value are the keys followed by "=".
+var refusedMountOptions = map[string]bool{
+	"suid":      true,
+	"dev":       true,
+	"rootmode=": true,
+	"user_id=":  true,
+	"group_id=": true,
+	"fd=":       true,
+}
+
+func prepareMountOptions(options []string) ([]string, []string) {
 	csiMountOptions := []string{
 		"nodev",
 		"nosuid",
@@ -223,7 +725,7 @@ func prepareMountOptions(options []string) ([]string, []string) {
 	for _, o := range optionSet.List() {
 		if strings.HasPrefix(o, "o=") {
 			v := o[2:]
-			if allowedOptions[v] {
+			if allowedMountOptions[v] {
 				csiMountOptions = append(csiMountOptions, v)
 			} else {
 				klog.Warningf("got invalid mount option %q. Will discard invalid options and continue to mount.", v)
@@ -237,21 +739,24 @@ func prepareMountOptions(options []string) ([]string, []string) {
 
 type FdPassingSockets struct {
 	// key is target path
-	sockets      map[string]*FdPassingSocket
+	sockets map[string]*FdPassingSocket
+	// mountErrors are the errors of the mounts failed after Mount returned. key is target path
+	mountErrors  map[string]error
 	socketsMutex sync.Mutex
 }
 
 type FdPassingSocket struct {
 	socketPath string
 	listener   *net.UnixListener
+	session    *fdPassingSession
 	exitChan   chan bool
 	closed     bool
 }
 
 func newFdPassingSockets() *FdPassingSockets {
 	return &FdPassingSockets{
-		map[string]*FdPassingSocket{},
-		sync.Mutex{},
+		sockets:     map[string]*FdPassingSocket{},
+		mountErrors: map[string]error{},
 	}
 }
 
@@ -276,6 +781,51 @@ func (fds *FdPassingSockets) register(targetPath string, sockPath string, listen
 	return nil
 }
 
+// MountError returns the error of the last mount of targetPath failed asynchronously, if any.
+func (fds *FdPassingSockets) MountError(targetPath string) error {
+	fds.socketsMutex.Lock()
+	defer fds.socketsMutex.Unlock()
+
+	return fds.mountErrors[targetPath]
+}
+
+// TakeMountError returns the error like MountError and forgets it, so that the mount can be retried.
+func (fds *FdPassingSockets) TakeMountError(targetPath string) error {
+	fds.socketsMutex.Lock()
+	defer fds.socketsMutex.Unlock()
+
+	err := fds.mountErrors[targetPath]
+	delete(fds.mountErrors, targetPath)
+
+	return err
+}
+
+// attach sets the session serving the socket of targetPath.
+func (fds *FdPassingSockets) attach(targetPath string, session *fdPassingSession) {
+	fds.socketsMutex.Lock()
+	defer fds.socketsMutex.Unlock()
+
+	if sock, ok := fds.sockets[targetPath]; ok {
+		sock.session = session
+	}
+}
+
+// Notify sends event to the clients watching the socket of targetPath.
+// It does not wait for the clients to handle it.
+func (fds *FdPassingSockets) Notify(targetPath string, event starter.Event) {
+	fds.socketsMutex.Lock()
+	var session *fdPassingSession
+	if sock, ok := fds.sockets[targetPath]; ok {
+		session = sock.session
+	}
+	fds.socketsMutex.Unlock()
+	if session == nil {
+		return
+	}
+
+	session.notify(event, NotificationTimeout)
+}
+
 func (fds *FdPassingSockets) get(targetPath string) *FdPassingSocket {
 	fds.socketsMutex.Lock()
 	defer fds.socketsMutex.Unlock()
@@ -311,6 +861,23 @@ func (fds *FdPassingSockets) CloseAndUnregister(targetPath string, onlyClose boo
 	fds.socketsMutex.Lock()
 	defer fds.socketsMutex.Unlock()
 
+	return fds.closeAndUnregisterLocked(targetPath, onlyClose)
+}
+
+// unregisterWithError closes and unregisters the socket of targetPath, and records err of the mount if not nil.
+// Both are done under the lock, so that NodePublishVolume sees the error whenever the socket is gone.
+func (fds *FdPassingSockets) unregisterWithError(targetPath string, err error) error {
+	fds.socketsMutex.Lock()
+	defer fds.socketsMutex.Unlock()
+
+	if err != nil {
+		fds.mountErrors[targetPath] = err
+	}
+
+	return fds.closeAndUnregisterLocked(targetPath, false)
+}
+
+func (fds *FdPassingSockets) closeAndUnregisterLocked(targetPath string, onlyClose bool) error {
 	sock, ok := fds.sockets[targetPath]
 	if !ok {
 		// fd-passing socket is already unregistered
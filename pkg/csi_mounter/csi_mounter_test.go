@@ -19,10 +19,22 @@ limitations under the License.
 package csimounter
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
+
+	"github.com/pfnet-research/meta-fuse-csi-plugin/pkg/csi_mounter/fake"
+	starter "github.com/pfnet-research/meta-fuse-csi-plugin/pkg/fuse_starter"
+	"k8s.io/apimachinery/pkg/util/sets"
 )
 
 var defaultCsiMountOptions = []string{
@@ -92,3 +104,828 @@ func countOptionOccurrence(options []string) map[string]int {
 
 	return dict
 }
+
+func TestCreateAndRegisterFdPassingSocketWithDeepPath(t *testing.T) {
+	t.Parallel()
+
+	// Mimic kubelet emptyDir paths which exceed the 108 bytes limit of sun_path.
+	base := filepath.Join(t.TempDir(), "var/lib/kubelet/pods/d2013878-3d56-45f9-89ec-0826612c89b6/volumes/kubernetes.io~empty-dir")
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("failed to get the current directory: %v", err)
+	}
+
+	sc := fake.NewSyscalls(fake.NewMounter())
+	m := NewWithSyscalls(sc.Mounter, sc)
+
+	const numVolumes = 16
+	var wg sync.WaitGroup
+	errs := make([]error, numVolumes)
+	for i := 0; i < numVolumes; i++ {
+		sockDir := filepath.Join(base, fmt.Sprintf("fuse-fd-passing-%d", i))
+		if err := os.MkdirAll(sockDir, 0o750); err != nil {
+			t.Fatalf("failed to create %q: %v", sockDir, err)
+		}
+		if len(filepath.Join(sockDir, "fuse-csi-ephemeral.sock")) <= 108 {
+			t.Fatalf("socket path %q is not long enough for the test", sockDir)
+		}
+
+		wg.Add(1)
+		go func(i int, sockDir string) {
+			defer wg.Done()
+			errs[i] = m.createAndRegisterFdPassingSocket(fmt.Sprintf("target-%d", i), sockDir, "fuse-csi-ephemeral.sock")
+		}(i, sockDir)
+	}
+	wg.Wait()
+
+	for i := 0; i < numVolumes; i++ {
+		if errs[i] != nil {
+			t.Fatalf("failed to create fd-passing socket %d: %v", i, errs[i])
+		}
+
+		target := fmt.Sprintf("target-%d", i)
+		sock := m.FdPassingSockets.get(target)
+		if sock == nil {
+			t.Fatalf("fd-passing socket for %q is not registered", target)
+		}
+		fi, err := os.Stat(sock.socketPath)
+		if err != nil {
+			t.Fatalf("failed to stat %q: %v", sock.socketPath, err)
+		}
+		if fi.Mode()&os.ModeSocket == 0 {
+			t.Errorf("%q is not a socket", sock.socketPath)
+		}
+
+		// Clients also have to avoid the sun_path limit to connect to the deep path.
+		dir, err := os.Open(filepath.Dir(sock.socketPath))
+		if err != nil {
+			t.Fatalf("failed to open %q: %v", filepath.Dir(sock.socketPath), err)
+		}
+		conn, err := net.Dial("unix", filepath.Join(fmt.Sprintf("/proc/self/fd/%d", dir.Fd()), filepath.Base(sock.socketPath)))
+		dir.Close()
+		if err != nil {
+			t.Errorf("failed to connect to %q: %v", sock.socketPath, err)
+		} else {
+			conn.Close()
+		}
+
+		if err := m.FdPassingSockets.CloseAndUnregister(target, false); err != nil {
+			t.Errorf("failed to close fd-passing socket for %q: %v", target, err)
+		}
+		if _, err := os.Stat(sock.socketPath); !os.IsNotExist(err) {
+			t.Errorf("socket %q is not removed: %v", sock.socketPath, err)
+		}
+	}
+
+	if cwd, _ := os.Getwd(); cwd != wd {
+		t.Errorf("current directory is changed from %q to %q", wd, cwd)
+	}
+}
+
+func TestReadRequest(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name            string
+		input           string
+		delayedInput    string
+		closeClient     bool
+		expectedRequest starter.Request
+		expectErr       bool
+	}{
+		{
+			name:            "should read the request",
+			input:           `{"op":"unmount","token":"abc","lazy":true}`,
+			expectedRequest: starter.Request{Op: starter.RequestOpUnmount, Token: "abc", Lazy: true},
+		},
+		{
+			name:            "should treat a client not sending a request as mount",
+			input:           "",
+			expectedRequest: starter.Request{Op: starter.RequestOpMount},
+		},
+		{
+			name:            "should treat a client closing without a request as mount",
+			input:           "",
+			closeClient:     true,
+			expectedRequest: starter.Request{Op: starter.RequestOpMount},
+		},
+		{
+			name:            "should wait for the rest of the request longer than the first byte",
+			input:           `{"op":"status",`,
+			delayedInput:    `"token":"abc"}`,
+			expectedRequest: starter.Request{Op: starter.RequestOpStatus, Token: "abc"},
+		},
+		{
+			name:        "should return error for a malformed request",
+			input:       "{",
+			closeClient: true,
+			expectErr:   true,
+		},
+		{
+			name:      "should return error for a client stopping in the middle of the request",
+			input:     `{"op":`,
+			expectErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+
+		client, server := net.Pipe()
+		go func(input, delayedInput string, closeClient bool) {
+			if input != "" {
+				//nolint:errcheck
+				client.Write([]byte(input))
+			}
+			if delayedInput != "" {
+				// Later than the deadline of the first byte, but within the one of the request.
+				time.Sleep(150 * time.Millisecond)
+				//nolint:errcheck
+				client.Write([]byte(delayedInput))
+			}
+			if closeClient {
+				client.Close()
+			}
+		}(tc.input, tc.delayedInput, tc.closeClient)
+
+		req, err := readRequest(server, 100*time.Millisecond, 500*time.Millisecond)
+		server.Close()
+		client.Close()
+		if tc.expectErr {
+			if err == nil {
+				t.Errorf("Expected error but got none")
+			}
+
+			continue
+		}
+		if err != nil {
+			t.Errorf("Did not expect error but got: %v", err)
+			continue
+		}
+		if !reflect.DeepEqual(req, tc.expectedRequest) {
+			t.Errorf("Got request %+v, but expected %+v", req, tc.expectedRequest)
+		}
+	}
+}
+
+func TestFdPassingSessionRefusesUnmount(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name          string
+		sessionToken  string
+		request       starter.Request
+		expectedError string
+	}{
+		{
+			name:          "should refuse to unmount the target not mounted via the socket",
+			sessionToken:  "",
+			request:       starter.Request{Op: starter.RequestOpUnmount, Token: ""},
+			expectedError: "target is not mounted via the fd-passing socket",
+		},
+		{
+			name:          "should refuse to unmount without the token",
+			sessionToken:  "abc",
+			request:       starter.Request{Op: starter.RequestOpUnmount},
+			expectedError: "token does not match the one of the mount",
+		},
+		{
+			name:          "should refuse to unmount with a wrong token",
+			sessionToken:  "abc",
+			request:       starter.Request{Op: starter.RequestOpUnmount, Token: "abd"},
+			expectedError: "token does not match the one of the mount",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+
+		s := &fdPassingSession{target: "target", token: tc.sessionToken}
+		err := s.unmount(tc.request)
+		if err == nil {
+			t.Errorf("Expected error but got none")
+		} else if !strings.Contains(err.Error(), tc.expectedError) {
+			t.Errorf("Got error %q, but expected to contain %q", err, tc.expectedError)
+		}
+		if s.token != tc.sessionToken {
+			t.Errorf("Got token %q, but expected %q", s.token, tc.sessionToken)
+		}
+	}
+}
+
+func TestFdPassingSessionMountArgs(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name            string
+		csiMountOptions []string
+		requested       []string
+		expectedSource  string
+		expectedFstype  string
+		expectedOptions []string
+		expectedError   string
+	}{
+		{
+			name:            "should keep the options without requested ones",
+			csiMountOptions: append(defaultCsiMountOptions, "rw"),
+			requested:       nil,
+			expectedSource:  "volume",
+			expectedFstype:  "fuse",
+			expectedOptions: append(defaultCsiMountOptions, "rw"),
+		},
+		{
+			name:            "should apply the options requested by libfuse3",
+			csiMountOptions: append(defaultCsiMountOptions, "rw"),
+			requested:       []string{"rw", "nosuid", "nodev", "noatime", "fsname=user@host:/", "subtype=sshfs", "allow_other", "default_permissions", "max_read=131072"},
+			expectedSource:  "user@host:/",
+			expectedFstype:  "fuse.sshfs",
+			expectedOptions: append(defaultCsiMountOptions, "rw", "noatime", "max_read=131072"),
+		},
+		{
+			name:            "should make a read-write volume read-only",
+			csiMountOptions: append(defaultCsiMountOptions, "rw"),
+			requested:       []string{"ro"},
+			expectedSource:  "volume",
+			expectedFstype:  "fuse",
+			expectedOptions: append(defaultCsiMountOptions, "ro"),
+		},
+		{
+			name:            "should keep a read-only volume read-only",
+			csiMountOptions: append(defaultCsiMountOptions, "ro"),
+			requested:       []string{"rw"},
+			expectedSource:  "volume",
+			expectedFstype:  "fuse",
+			expectedOptions: append(defaultCsiMountOptions, "ro"),
+		},
+		{
+			// "-o" of fusermount3 for "sshfs user@host:/dir /mnt"
+			name:            "should mount a read-only volume with the options of libfuse3 sshfs",
+			csiMountOptions: append(defaultCsiMountOptions, "ro"),
+			requested:       strings.Split("rw,nosuid,nodev,fsname=user@host:/dir,subtype=sshfs", ","),
+			expectedSource:  "user@host:/dir",
+			expectedFstype:  "fuse.sshfs",
+			expectedOptions: append(defaultCsiMountOptions, "ro"),
+		},
+		{
+			name:            "should drop unknown options",
+			csiMountOptions: append(defaultCsiMountOptions, "rw"),
+			requested:       []string{"x-systemd.automount", "context=system_u:object_r:fusefs_t:s0", "blksize=4096", "blkdev", "noatime"},
+			expectedSource:  "volume",
+			expectedFstype:  "fuse",
+			expectedOptions: append(defaultCsiMountOptions, "rw", "noatime"),
+		},
+		{
+			name:            "should refuse dev",
+			csiMountOptions: append(defaultCsiMountOptions, "rw"),
+			requested:       []string{"dev"},
+			expectedError:   `option "dev" is not allowed`,
+		},
+		{
+			name:            "should refuse suid",
+			csiMountOptions: append(defaultCsiMountOptions, "rw"),
+			requested:       []string{"suid"},
+			expectedError:   `option "suid" is not allowed`,
+		},
+		{
+			name:            "should refuse the options set by the CSI driver",
+			csiMountOptions: append(defaultCsiMountOptions, "rw"),
+			requested:       []string{"user_id=0"},
+			expectedError:   `option "user_id=0" is not allowed`,
+		},
+		{
+			name:            "should refuse fsname taken as an option of mount(8)",
+			csiMountOptions: append(defaultCsiMountOptions, "rw"),
+			requested:       []string{"fsname=--bind"},
+			expectedError:   `option "fsname=--bind" is invalid: must not start with '-'`,
+		},
+		{
+			name:            "should refuse fsname with whitespaces",
+			csiMountOptions: append(defaultCsiMountOptions, "rw"),
+			requested:       []string{"fsname=a -T/fstab"},
+			expectedError:   `option "fsname=a -T/fstab" is invalid: must not contain commas, whitespaces or control characters`,
+		},
+		{
+			name:            "should refuse subtype with a comma",
+			csiMountOptions: append(defaultCsiMountOptions, "rw"),
+			requested:       []string{"subtype=sshfs,ext4"},
+			expectedError:   `option "subtype=sshfs,ext4" is invalid: must consist of alphanumerics, '.', '_' and '-'`,
+		},
+		{
+			name:            "should refuse an empty subtype",
+			csiMountOptions: append(defaultCsiMountOptions, "rw"),
+			requested:       []string{"subtype="},
+			expectedError:   `option "subtype=" is invalid: must not be empty`,
+		},
+		{
+			name:            "should refuse an invalid max_read",
+			csiMountOptions: append(defaultCsiMountOptions, "rw"),
+			requested:       []string{"max_read=x"},
+			expectedError:   `option "max_read=x" has an invalid value`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+
+		s := &fdPassingSession{volumeName: "volume", fstype: "fuse", csiMountOptions: tc.csiMountOptions}
+		source, fstype, options, err := s.mountArgs(tc.requested)
+		if tc.expectedError != "" {
+			if err == nil {
+				t.Errorf("Expected error but got none")
+			} else if err.Error() != tc.expectedError {
+				t.Errorf("Got error %q, but expected %q", err, tc.expectedError)
+			}
+
+			continue
+		}
+		if err != nil {
+			t.Errorf("Did not expect error but got: %v", err)
+			continue
+		}
+		if source != tc.expectedSource {
+			t.Errorf("Got source %q, but expected %q", source, tc.expectedSource)
+		}
+		if fstype != tc.expectedFstype {
+			t.Errorf("Got fstype %q, but expected %q", fstype, tc.expectedFstype)
+		}
+		if !reflect.DeepEqual(countOptionOccurrence(options), countOptionOccurrence(tc.expectedOptions)) {
+			t.Errorf("Got options %v, but expected %v", options, tc.expectedOptions)
+		}
+	}
+}
+
+// roundTrip serves req by s on a pipe and returns the response.
+func roundTrip(t *testing.T, s *fdPassingSession, req starter.Request) starter.Response {
+	client, server := net.Pipe()
+	defer client.Close()
+	go s.handle(server)
+
+	b, _ := json.Marshal(req)
+	if _, err := client.Write(b); err != nil {
+		t.Fatalf("failed to write the request: %v", err)
+	}
+	resp := starter.Response{}
+	if err := json.NewDecoder(client).Decode(&resp); err != nil {
+		t.Fatalf("failed to read the response: %v", err)
+	}
+
+	return resp
+}
+
+func TestFdPassingSessionStatusAndReport(t *testing.T) {
+	t.Parallel()
+
+	s := &fdPassingSession{
+		target: "target",
+		mc:     starter.MountConfig{VolumeName: "volume", MountPoint: "target"},
+		token:  "abc",
+	}
+
+	testCases := []struct {
+		name           string
+		request        starter.Request
+		expectedError  string
+		expectedStatus *starter.MountStatus
+	}{
+		{
+			name:           "should return the status without report",
+			request:        starter.Request{Op: starter.RequestOpStatus, Token: "abc"},
+			expectedStatus: &starter.MountStatus{Mounted: true, VolumeName: "volume", MountPoint: "target"},
+		},
+		{
+			name:          "should refuse the status with a wrong token",
+			request:       starter.Request{Op: starter.RequestOpStatus, Token: "abd"},
+			expectedError: "token does not match the one of the mount",
+		},
+		{
+			name:          "should refuse the report without the report",
+			request:       starter.Request{Op: starter.RequestOpReport, Token: "abc"},
+			expectedError: "report is not specified",
+		},
+		{
+			name:          "should refuse the report with a wrong token",
+			request:       starter.Request{Op: starter.RequestOpReport, Token: "abd", Report: &starter.Report{Ready: true}},
+			expectedError: "token does not match the one of the mount",
+		},
+		{
+			name:    "should accept the report",
+			request: starter.Request{Op: starter.RequestOpReport, Token: "abc", Report: &starter.Report{Ready: true, Healthy: true, Message: "ready"}},
+		},
+		{
+			name:    "should return the status with the report",
+			request: starter.Request{Op: starter.RequestOpStatus, Token: "abc"},
+			expectedStatus: &starter.MountStatus{
+				Mounted:    true,
+				VolumeName: "volume",
+				MountPoint: "target",
+				Report:     &starter.Report{Ready: true, Healthy: true, Message: "ready"},
+			},
+		},
+	}
+
+	// The test cases depend on the reports of the previous ones.
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+
+		resp := roundTrip(t, s, tc.request)
+		if tc.expectedError != "" {
+			if !strings.Contains(resp.Error, tc.expectedError) {
+				t.Errorf("Got error %q, but expected to contain %q", resp.Error, tc.expectedError)
+			}
+
+			continue
+		}
+		if resp.Error != "" {
+			t.Errorf("Did not expect error but got: %v", resp.Error)
+			continue
+		}
+		if resp.Status != nil {
+			if resp.Status.Report != nil && resp.Status.ReportedAt == nil {
+				t.Errorf("Expected reportedAt with the report but got none")
+			}
+			resp.Status.ReportedAt = nil
+		}
+		if !reflect.DeepEqual(resp.Status, tc.expectedStatus) {
+			t.Errorf("Got status %+v, but expected %+v", resp.Status, tc.expectedStatus)
+		}
+	}
+}
+
+func TestFdPassingSessionNotify(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name             string
+		read             bool
+		expectedWatchers int
+	}{
+		{
+			name:             "should keep the watcher receiving the notification",
+			read:             true,
+			expectedWatchers: 1,
+		},
+		{
+			name:             "should remove the watcher not receiving the notification",
+			read:             false,
+			expectedWatchers: 0,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+
+		s := &fdPassingSession{target: "target", token: "abc"}
+		resp := roundTrip(t, s, starter.Request{Op: starter.RequestOpWatch, Token: "abd"})
+		if resp.Error == "" {
+			t.Errorf("Expected error but got none")
+		}
+
+		client, server := net.Pipe()
+		go s.handle(server)
+		b, _ := json.Marshal(starter.Request{Op: starter.RequestOpWatch, Token: "abc"})
+		//nolint:errcheck
+		client.Write(b)
+		dec := json.NewDecoder(client)
+		resp = starter.Response{}
+		if err := dec.Decode(&resp); err != nil || resp.Error != "" {
+			t.Errorf("Did not expect error but got: %v %v", err, resp.Error)
+			client.Close()
+			continue
+		}
+
+		// Writes on net.Pipe block until the client reads them.
+		events := make(chan starter.Event, 1)
+		if tc.read {
+			go func() {
+				n := starter.Notification{}
+				if err := dec.Decode(&n); err != nil {
+					return
+				}
+				events <- n.Event
+			}()
+		}
+
+		s.notify(starter.EventTeardown, 100*time.Millisecond)
+		if tc.read {
+			if event := <-events; event != starter.EventTeardown {
+				t.Errorf("Got event %q, but expected %q", event, starter.EventTeardown)
+			}
+		}
+		s.mu.Lock()
+		watchers := len(s.watchers)
+		s.mu.Unlock()
+		if watchers != tc.expectedWatchers {
+			t.Errorf("Got %d watchers, but expected %d", watchers, tc.expectedWatchers)
+		}
+		client.Close()
+	}
+}
+
+// waitForUnregister waits for the goroutine serving the socket of target to close it.
+func waitForUnregister(t *testing.T, m *Mounter, target string) {
+	for i := 0; m.FdPassingSockets.Exist(target); i++ {
+		if i > 100 {
+			t.Fatalf("fd-passing socket for %q is not unregistered", target)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMounterFdPassing(t *testing.T) {
+	t.Parallel()
+
+	const target = "/var/lib/kubelet/pods/d2013878-3d56-45f9-89ec-0826612c89b6/volumes/kubernetes.io~csi/test-volume/mount"
+	sp := filepath.Join(t.TempDir(), "fuse-csi-ephemeral.sock")
+	sc := fake.NewSyscalls(fake.NewMounter())
+	m := NewWithSyscalls(sc.Mounter, sc)
+
+	// NodePublishVolume
+	if err := m.Mount("test-volume", target, "fuse", []string{sp, "noatime"}); err != nil {
+		t.Fatalf("Did not expect error but got: %v", err)
+	}
+	if _, ok := sc.MountOptions(target); ok {
+		t.Errorf("Expected the target not to be mounted before the handshake")
+	}
+
+	// The sidecar receives the fd.
+	mc, err := starter.PrepareMountConfig(sp, time.Second, []string{"subtype=sshfs"})
+	if err != nil {
+		t.Fatalf("Did not expect error but got: %v", err)
+	}
+	defer syscall.Close(mc.FileDescriptor)
+	if mc.VolumeName != "test-volume" || mc.MountPoint != target || mc.Token == "" {
+		t.Errorf("Got mount config %+v, but expected the volume, the target and a token", mc)
+	}
+	options, ok := sc.MountOptions(target)
+	if !ok {
+		t.Fatalf("Expected the target to be mounted but it is not")
+	}
+	if !sets.NewString(options...).HasAll("nodev", "nosuid", "allow_other") {
+		t.Errorf("Got options %v, but expected the enforced options", options)
+	}
+
+	status, err := starter.RequestStatus(sp, mc.Token)
+	if err != nil {
+		t.Fatalf("Did not expect error but got: %v", err)
+	}
+	if !status.Mounted {
+		t.Errorf("Got status %+v, but expected mounted", status)
+	}
+
+	// The sidecar unmounts like fusermount3 -u.
+	if err := starter.RequestUnmount(sp, mc.Token, false); err != nil {
+		t.Fatalf("Did not expect error but got: %v", err)
+	}
+	if _, ok := sc.MountOptions(target); ok {
+		t.Errorf("Expected the target to be unmounted but it is not")
+	}
+	if err := starter.RequestUnmount(sp, mc.Token, false); !errors.Is(err, starter.ErrRefused) {
+		t.Errorf("Got error %v, but expected %v", err, starter.ErrRefused)
+	}
+
+	// NodeUnpublishVolume
+	if err := m.FdPassingSockets.CloseAndUnregister(target, true); err != nil {
+		t.Fatalf("Did not expect error but got: %v", err)
+	}
+	m.FdPassingSockets.WaitForExit(target)
+	if m.FdPassingSockets.Exist(target) {
+		t.Errorf("Expected the socket to be unregistered but it is not")
+	}
+	if _, err := os.Stat(sp); !os.IsNotExist(err) {
+		t.Errorf("socket %q is not removed: %v", sp, err)
+	}
+}
+
+func TestMounterFdPassingRemount(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name          string
+		options       []string
+		expectedError bool
+	}{
+		{
+			name:    "should remount the target when remount is allowed",
+			options: []string{AllowRemountOption},
+		},
+		{
+			name:          "should refuse remount when remount is not allowed",
+			expectedError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+
+		const target = "/var/lib/kubelet/pods/d2013878-3d56-45f9-89ec-0826612c89b6/volumes/kubernetes.io~csi/test-volume/mount"
+		sp := filepath.Join(t.TempDir(), "fuse-csi-ephemeral.sock")
+		sc := fake.NewSyscalls(fake.NewMounter())
+		m := NewWithSyscalls(sc.Mounter, sc)
+
+		if err := m.Mount("test-volume", target, "fuse", append([]string{sp, "rw"}, tc.options...)); err != nil {
+			t.Fatalf("Did not expect error but got: %v", err)
+		}
+		mc, err := starter.PrepareMountConfig(sp, time.Second, nil)
+		if err != nil {
+			t.Fatalf("Did not expect error but got: %v", err)
+		}
+		syscall.Close(mc.FileDescriptor)
+
+		remounted, err := starter.RequestRemount(sp, mc.Token, []string{"ro"})
+		if tc.expectedError {
+			if !errors.Is(err, starter.ErrRefused) {
+				t.Errorf("Got error %v, but expected %v", err, starter.ErrRefused)
+			}
+			if _, ok := sc.MountOptions(target); !ok {
+				t.Errorf("Expected the target to stay mounted but it is not")
+			}
+		} else {
+			if err != nil {
+				t.Errorf("Did not expect error but got: %v", err)
+			} else {
+				syscall.Close(remounted.FileDescriptor)
+				if remounted.Token == mc.Token {
+					t.Errorf("Expected a new token but got the same one")
+				}
+			}
+			if options, _ := sc.MountOptions(target); !sets.NewString(options...).Has("ro") {
+				t.Errorf("Got options %v, but expected the remounted options", options)
+			}
+		}
+
+		if err := m.FdPassingSockets.CloseAndUnregister(target, true); err != nil {
+			t.Errorf("Did not expect error but got: %v", err)
+		}
+		m.FdPassingSockets.WaitForExit(target)
+	}
+}
+
+func TestMounterFdPassingMountAgain(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name            string
+		checkConnection func(target string) error
+		expectedError   bool
+	}{
+		{
+			name: "should mount again when the FUSE connection is lost",
+			checkConnection: func(_ string) error {
+				return syscall.ENOTCONN
+			},
+		},
+		{
+			name: "should refuse to mount again when the FUSE connection is alive",
+			checkConnection: func(_ string) error {
+				return nil
+			},
+			expectedError: true,
+		},
+		{
+			name:          "should refuse to mount again without the connection check",
+			expectedError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+
+		const target = "/var/lib/kubelet/pods/d2013878-3d56-45f9-89ec-0826612c89b6/volumes/kubernetes.io~csi/test-volume/mount"
+		sp := filepath.Join(t.TempDir(), "fuse-csi-ephemeral.sock")
+		sc := fake.NewSyscalls(fake.NewMounter())
+		m := NewWithSyscalls(sc.Mounter, sc)
+		m.CheckConnection = tc.checkConnection
+
+		if err := m.Mount("test-volume", target, "fuse", []string{sp, "rw"}); err != nil {
+			t.Fatalf("Did not expect error but got: %v", err)
+		}
+		mc, err := starter.PrepareMountConfig(sp, time.Second, nil)
+		if err != nil {
+			t.Fatalf("Did not expect error but got: %v", err)
+		}
+		syscall.Close(mc.FileDescriptor)
+
+		// The sidecar is restarted and handshakes again.
+		again, err := starter.PrepareMountConfig(sp, time.Second, nil)
+		if tc.expectedError {
+			if !errors.Is(err, starter.ErrRefused) {
+				t.Errorf("Got error %v, but expected %v", err, starter.ErrRefused)
+			}
+		} else if err != nil {
+			t.Errorf("Did not expect error but got: %v", err)
+		} else {
+			syscall.Close(again.FileDescriptor)
+			if again.Token == mc.Token {
+				t.Errorf("Expected a new token but got the same one")
+			}
+		}
+		if _, ok := sc.MountOptions(target); !ok {
+			t.Errorf("Expected the target to be mounted but it is not")
+		}
+
+		if err := m.FdPassingSockets.CloseAndUnregister(target, true); err != nil {
+			t.Errorf("Did not expect error but got: %v", err)
+		}
+		m.FdPassingSockets.WaitForExit(target)
+	}
+}
+
+func TestMounterFdPassingErrors(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name                string
+		openErr             error
+		mountErr            error
+		chownErr            error
+		expectedMountError  bool
+		expectedClientError string
+	}{
+		{
+			name:                "should refuse the handshake when /dev/fuse cannot be opened",
+			openErr:             syscall.EPERM,
+			expectedClientError: "failed to open the device /dev/fuse",
+		},
+		{
+			name:                "should refuse the handshake when the mount failed",
+			mountErr:            syscall.EPERM,
+			expectedClientError: "failed to mount the fuse filesystem",
+		},
+		{
+			name:               "should return error when the socket cannot be chowned",
+			chownErr:           syscall.EPERM,
+			expectedMountError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+
+		const target = "/var/lib/kubelet/pods/d2013878-3d56-45f9-89ec-0826612c89b6/volumes/kubernetes.io~csi/test-volume/mount"
+		sp := filepath.Join(t.TempDir(), "fuse-csi-ephemeral.sock")
+		sc := fake.NewSyscalls(fake.NewMounter())
+		sc.OpenErr = tc.openErr
+		sc.MountErr = tc.mountErr
+		sc.ChownErr = tc.chownErr
+		m := NewWithSyscalls(sc.Mounter, sc)
+
+		err := m.Mount("test-volume", target, "fuse", []string{sp})
+		if tc.expectedMountError {
+			if err == nil {
+				t.Errorf("Expected error but got none")
+			}
+			if m.FdPassingSockets.Exist(target) {
+				t.Errorf("Expected the socket not to be registered but it is")
+			}
+			if _, err := os.Stat(sp); !os.IsNotExist(err) {
+				t.Errorf("socket %q is not removed: %v", sp, err)
+			}
+
+			continue
+		}
+		if err != nil {
+			t.Errorf("Did not expect error but got: %v", err)
+			continue
+		}
+
+		_, err = starter.PrepareMountConfig(sp, time.Second, nil)
+		if !errors.Is(err, starter.ErrRefused) || !strings.Contains(err.Error(), tc.expectedClientError) {
+			t.Errorf("Got error %v, but expected to contain %q", err, tc.expectedClientError)
+		}
+
+		// The socket is closed so that NodePublishVolume creates it again.
+		waitForUnregister(t, m, target)
+		if _, err := os.Stat(sp); !os.IsNotExist(err) {
+			t.Errorf("socket %q is not removed: %v", sp, err)
+		}
+
+		// The failure is kept for the next CSI call until it is taken.
+		if err := m.FdPassingSockets.MountError(target); err == nil || !strings.Contains(err.Error(), tc.expectedClientError) {
+			t.Errorf("Got mount error %v, but expected to contain %q", err, tc.expectedClientError)
+		}
+		if err := m.FdPassingSockets.TakeMountError(target); err == nil {
+			t.Errorf("Expected error but got none")
+		}
+		if err := m.FdPassingSockets.MountError(target); err != nil {
+			t.Errorf("Did not expect error but got: %v", err)
+		}
+
+		// The mount can be retried.
+		sc.OpenErr = nil
+		sc.MountErr = nil
+		if err := m.Mount("test-volume", target, "fuse", []string{sp}); err != nil {
+			t.Errorf("Did not expect error but got: %v", err)
+			continue
+		}
+		mc, err := starter.PrepareMountConfig(sp, time.Second, nil)
+		if err != nil {
+			t.Errorf("Did not expect error but got: %v", err)
+		} else {
+			syscall.Close(mc.FileDescriptor)
+		}
+		if err := m.FdPassingSockets.CloseAndUnregister(target, false); err != nil {
+			t.Errorf("Did not expect error but got: %v", err)
+		}
+	}
+}
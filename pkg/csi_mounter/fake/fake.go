@@ -0,0 +1,116 @@
+/*
+Copyright 2023 Preferred Networks, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package fake provides the fakes of the privileged operations of csimounter.Mounter
+// to test the fd-passing sockets without /dev/fuse and mount(2).
+package fake
+
+import (
+	"fmt"
+	"syscall"
+	"time"
+
+	"k8s.io/mount-utils"
+)
+
+// Mounter is mount.MounterForceUnmounter keeping the mounts in memory.
+type Mounter struct {
+	*mount.FakeMounter
+}
+
+// NewMounter returns Mounter without mounts.
+func NewMounter() *Mounter {
+	return &Mounter{
+		FakeMounter: mount.NewFakeMounter(nil),
+	}
+}
+
+func (m *Mounter) UnmountWithForce(target string, _ time.Duration) error {
+	return m.Unmount(target)
+}
+
+// Syscalls is csimounter.Syscalls mounting the FUSE filesystems on Mounter,
+// so that the mounts are also seen by the methods of mount.Interface, like IsLikelyNotMountPoint.
+// The FUSE fd is the read end of a pipe.
+// Errors set to the fields are returned by the corresponding operations.
+type Syscalls struct {
+	OpenErr    error
+	MountErr   error
+	UnmountErr error
+	ChownErr   error
+
+	Mounter *Mounter
+}
+
+// NewSyscalls returns Syscalls mounting the FUSE filesystems on m.
+func NewSyscalls(m *Mounter) *Syscalls {
+	return &Syscalls{
+		Mounter: m,
+	}
+}
+
+func (f *Syscalls) OpenFuseDevice() (int, error) {
+	if f.OpenErr != nil {
+		return -1, f.OpenErr
+	}
+
+	p := make([]int, 2)
+	if err := syscall.Pipe(p); err != nil {
+		return -1, err
+	}
+	// The write end is not needed since nothing is served on the fake FUSE fd.
+	syscall.Close(p[1])
+
+	return p[0], nil
+}
+
+func (f *Syscalls) Mount(source, target, fstype string, options []string) error {
+	if f.MountErr != nil {
+		return f.MountErr
+	}
+	if _, ok := f.MountOptions(target); ok {
+		return fmt.Errorf("%q is already mounted", target)
+	}
+
+	return f.Mounter.Mount(source, target, fstype, options)
+}
+
+func (f *Syscalls) Unmount(target string, _ bool, _ time.Duration) error {
+	if f.UnmountErr != nil {
+		return f.UnmountErr
+	}
+	if _, ok := f.MountOptions(target); !ok {
+		return fmt.Errorf("%q is not mounted", target)
+	}
+
+	return f.Mounter.Unmount(target)
+}
+
+func (f *Syscalls) Chown(_ string, _, _ int) error {
+	return f.ChownErr
+}
+
+// MountOptions returns the options target is mounted with, and whether target is mounted.
+func (f *Syscalls) MountOptions(target string) ([]string, bool) {
+	mps, _ := f.Mounter.List()
+	for _, mp := range mps {
+		if mp.Path == target {
+			return mp.Opts, true
+		}
+	}
+
+	return nil, false
+}
@@ -0,0 +1,63 @@
+/*
+Copyright 2023 Preferred Networks, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csimounter
+
+import (
+	"os"
+	"syscall"
+	"time"
+
+	"k8s.io/mount-utils"
+)
+
+// Syscalls is the privileged operations of Mounter to serve the fd-passing sockets.
+// It is replaced with fake.Syscalls to test the handshake without privileges.
+type Syscalls interface {
+	// OpenFuseDevice opens /dev/fuse and returns the FUSE fd.
+	OpenFuseDevice() (int, error)
+	// Mount mounts the FUSE filesystem. options include "fd=<FUSE fd>".
+	Mount(source, target, fstype string, options []string) error
+	// Unmount unmounts target. lazy detaches it like umount -l, otherwise it is forcibly unmounted after timeout.
+	Unmount(target string, lazy bool, timeout time.Duration) error
+	// Chown changes the owner of the fd-passing socket and its directory.
+	Chown(path string, uid, gid int) error
+}
+
+// linuxSyscalls is Syscalls of the running system.
+type linuxSyscalls struct {
+	mounter mount.MounterForceUnmounter
+}
+
+func (l *linuxSyscalls) OpenFuseDevice() (int, error) {
+	return syscall.Open("/dev/fuse", syscall.O_RDWR, 0o644)
+}
+
+func (l *linuxSyscalls) Mount(source, target, fstype string, options []string) error {
+	return l.mounter.MountSensitiveWithoutSystemdWithMountFlags(source, target, fstype, options, nil, []string{"--internal-only"})
+}
+
+func (l *linuxSyscalls) Unmount(target string, lazy bool, timeout time.Duration) error {
+	if lazy {
+		return syscall.Unmount(target, syscall.MNT_DETACH)
+	}
+
+	return l.mounter.UnmountWithForce(target, timeout)
+}
+
+func (l *linuxSyscalls) Chown(path string, uid, gid int) error {
+	return os.Chown(path, uid, gid)
+}
@@ -0,0 +1,177 @@
+/*
+Copyright 2023 Preferred Networks, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fusestarter
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"sigs.k8s.io/yaml"
+)
+
+// Config is the configuration file of fuse-starter to run multiple mounters in one process.
+type Config struct {
+	Mounters []MounterConfig `json:"mounters"`
+}
+
+// MounterConfig configures a mounter for a FUSE volume.
+// Optional fields left empty fall back to the command line flags of fuse-starter.
+type MounterConfig struct {
+	// Name is used in logs and the status. Defaults to the socket file name without extension.
+	Name                string            `json:"name,omitempty"`
+	FdPassingSocketPath string            `json:"fdPassingSocketPath"`
+	MounterPath         string            `json:"mounterPath"`
+	Args                []string          `json:"args,omitempty"`
+	Env                 map[string]string `json:"env,omitempty"`
+	// FuseFd is the fd number of the FUSE fd in the mounter.
+	FuseFd *int `json:"fuseFd,omitempty"`
+	// FuseFdEnv is the name of the environment variable to pass the fd number to the mounter.
+	FuseFdEnv string `json:"fuseFdEnv,omitempty"`
+	// ConnectTimeout is how long to wait for the fd passing socket to become connectable, like "5m".
+	ConnectTimeout string `json:"connectTimeout,omitempty"`
+	// LogFormat is the format of the captured mounter output, "raw", "prefix" or "json".
+	LogFormat string `json:"logFormat,omitempty"`
+	// LogBufferLines is the number of recent lines of the mounter output included in the error on abnormal exit.
+	LogBufferLines *int `json:"logBufferLines,omitempty"`
+
+	Sandbox       *SandboxConfig       `json:"sandbox,omitempty"`
+	UserNamespace *UserNamespaceConfig `json:"userNamespace,omitempty"`
+	Hooks         *HooksConfig         `json:"hooks,omitempty"`
+
+	Supervise      *bool  `json:"supervise,omitempty"`
+	MaxRestarts    *int   `json:"maxRestarts,omitempty"`
+	ReadyFile      string `json:"readyFile,omitempty"`
+	ReadyProbePath string `json:"readyProbePath,omitempty"`
+	// ControlChannel reports the state of the mounter to the CSI driver.
+	ControlChannel *bool `json:"controlChannel,omitempty"`
+}
+
+// LoadConfig reads the configuration file in YAML or JSON.
+func LoadConfig(path string) (*Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config %q: %w", path, err)
+	}
+
+	c := Config{}
+	// JSON is also YAML. The fields are decoded by their json tags.
+	if err := yaml.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal config %q: %w", path, err)
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config %q: %w", path, err)
+	}
+
+	return &c, nil
+}
+
+// Validate checks required fields and fills the default names.
+func (c *Config) Validate() error {
+	if len(c.Mounters) == 0 {
+		return fmt.Errorf("no mounter is specified")
+	}
+
+	names := map[string]bool{}
+	sockets := map[string]bool{}
+	for i := range c.Mounters {
+		m := &c.Mounters[i]
+		if m.FdPassingSocketPath == "" {
+			return fmt.Errorf("mounters[%d]: fdPassingSocketPath is not specified", i)
+		}
+		if m.MounterPath == "" {
+			return fmt.Errorf("mounters[%d]: mounterPath is not specified", i)
+		}
+		if m.FuseFd != nil && (*m.FuseFd < DefaultFdNumber || *m.FuseFd > MaxFdNumber) {
+			return fmt.Errorf("mounters[%d]: fuseFd %d is out of range [%d, %d]", i, *m.FuseFd, DefaultFdNumber, MaxFdNumber)
+		}
+		if m.Sandbox != nil {
+			if err := m.Sandbox.Validate(); err != nil {
+				return fmt.Errorf("mounters[%d]: sandbox: %w", i, err)
+			}
+		}
+		if m.UserNamespace != nil {
+			if err := m.UserNamespace.Validate(); err != nil {
+				return fmt.Errorf("mounters[%d]: userNamespace: %w", i, err)
+			}
+			// Only one uid and gid are mapped in the namespace, and setgroups(2) is denied there.
+			if m.Sandbox != nil && (m.Sandbox.UID != nil || m.Sandbox.GID != nil || m.Sandbox.SupplementaryGroups != nil) {
+				return fmt.Errorf("mounters[%d]: uid, gid and supplementaryGroups of sandbox cannot be used with userNamespace. Use uid and gid of userNamespace instead", i)
+			}
+		}
+		if m.Hooks != nil {
+			if err := m.Hooks.Validate(); err != nil {
+				return fmt.Errorf("mounters[%d]: hooks: %w", i, err)
+			}
+		}
+		if _, err := m.ParseConnectTimeout(); err != nil {
+			return fmt.Errorf("mounters[%d]: %w", i, err)
+		}
+		if _, err := ParseLogFormat(m.LogFormat); err != nil {
+			return fmt.Errorf("mounters[%d]: %w", i, err)
+		}
+		if m.Name == "" {
+			m.Name = strings.TrimSuffix(filepath.Base(m.FdPassingSocketPath), filepath.Ext(m.FdPassingSocketPath))
+		}
+		if names[m.Name] {
+			return fmt.Errorf("mounters[%d]: name %q is duplicated", i, m.Name)
+		}
+		if sockets[m.FdPassingSocketPath] {
+			return fmt.Errorf("mounters[%d]: fdPassingSocketPath %q is duplicated", i, m.FdPassingSocketPath)
+		}
+		names[m.Name] = true
+		sockets[m.FdPassingSocketPath] = true
+	}
+
+	return nil
+}
+
+// Environ returns the environment variables for the mounter, which are added to the ones of fuse-starter.
+func (m *MounterConfig) Environ() []string {
+	env := os.Environ()
+	keys := make([]string, 0, len(m.Env))
+	for k := range m.Env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		env = append(env, fmt.Sprintf("%s=%s", k, m.Env[k]))
+	}
+
+	return env
+}
+
+// ParseConnectTimeout returns ConnectTimeout. It defaults to DefaultConnectTimeout.
+func (m *MounterConfig) ParseConnectTimeout() (time.Duration, error) {
+	if m.ConnectTimeout == "" {
+		return DefaultConnectTimeout, nil
+	}
+
+	d, err := time.ParseDuration(m.ConnectTimeout)
+	if err != nil {
+		return 0, fmt.Errorf("invalid connectTimeout %q: %w", m.ConnectTimeout, err)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("connectTimeout %q is negative", m.ConnectTimeout)
+	}
+
+	return d, nil
+}
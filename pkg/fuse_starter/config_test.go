@@ -0,0 +1,133 @@
+/*
+Copyright 2023 Preferred Networks, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fusestarter
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name          string
+		config        string
+		expectedNames []string
+		expectedError bool
+	}{
+		{
+			name: "should load mounters with default names",
+			config: `{"mounters": [
+				{"fdPassingSocketPath": "/fuse-fd-passing-1/bucket-1.sock", "mounterPath": "/bin/s3fs", "args": ["bucket-1", "/dev/fd/3"], "env": {"AWS_REGION": "us-east-1"}},
+				{"name": "second", "fdPassingSocketPath": "/fuse-fd-passing-2/bucket-2.sock", "mounterPath": "/bin/s3fs"}
+			]}`,
+			expectedNames: []string{"bucket-1", "second"},
+			expectedError: false,
+		},
+		{
+			name:          "should return error for no mounters",
+			config:        `{"mounters": []}`,
+			expectedError: true,
+		},
+		{
+			name:          "should return error for a mounter without socket path",
+			config:        `{"mounters": [{"mounterPath": "/bin/s3fs"}]}`,
+			expectedError: true,
+		},
+		{
+			name:          "should return error for a mounter without mounter path",
+			config:        `{"mounters": [{"fdPassingSocketPath": "/fuse-fd-passing/bucket.sock"}]}`,
+			expectedError: true,
+		},
+		{
+			name: "should return error for duplicated socket paths",
+			config: `{"mounters": [
+				{"name": "first", "fdPassingSocketPath": "/fuse-fd-passing/bucket.sock", "mounterPath": "/bin/s3fs"},
+				{"name": "second", "fdPassingSocketPath": "/fuse-fd-passing/bucket.sock", "mounterPath": "/bin/s3fs"}
+			]}`,
+			expectedError: true,
+		},
+		{
+			name: "should load the sandbox without ids in the user namespace",
+			config: `{"mounters": [
+				{"fdPassingSocketPath": "/fuse-fd-passing/bucket.sock", "mounterPath": "/bin/s3fs", "sandbox": {"noNewPrivs": true}, "userNamespace": {"uid": 1000, "gid": 1000}}
+			]}`,
+			expectedNames: []string{"bucket"},
+		},
+		{
+			name: "should return error for the sandbox changing ids in the user namespace",
+			config: `{"mounters": [
+				{"fdPassingSocketPath": "/fuse-fd-passing/bucket.sock", "mounterPath": "/bin/s3fs", "sandbox": {"uid": 1000}, "userNamespace": {}}
+			]}`,
+			expectedError: true,
+		},
+		{
+			name: "should return error for the sandbox changing supplementary groups in the user namespace",
+			config: `{"mounters": [
+				{"fdPassingSocketPath": "/fuse-fd-passing/bucket.sock", "mounterPath": "/bin/s3fs", "sandbox": {"supplementaryGroups": []}, "userNamespace": {}}
+			]}`,
+			expectedError: true,
+		},
+		{
+			name: "should load mounters in YAML",
+			config: `mounters:
+- fdPassingSocketPath: /fuse-fd-passing-1/bucket-1.sock
+  mounterPath: /bin/s3fs
+  args: [bucket-1, /dev/fd/3]
+  supervise: true
+`,
+			expectedNames: []string{"bucket-1"},
+		},
+		{
+			name:          "should return error for malformed config",
+			config:        `{"mounters": [`,
+			expectedError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+
+		path := filepath.Join(t.TempDir(), "config.json")
+		if err := os.WriteFile(path, []byte(tc.config), 0o600); err != nil {
+			t.Fatalf("failed to write config: %v", err)
+		}
+
+		c, err := LoadConfig(path)
+		if tc.expectedError && err == nil {
+			t.Errorf("Expected error but got none")
+		}
+		if err != nil {
+			if !tc.expectedError {
+				t.Errorf("Did not expect error but got: %v", err)
+			}
+
+			continue
+		}
+
+		if len(c.Mounters) != len(tc.expectedNames) {
+			t.Fatalf("Got %d mounters, but expected %d", len(c.Mounters), len(tc.expectedNames))
+		}
+		for i, m := range c.Mounters {
+			if m.Name != tc.expectedNames[i] {
+				t.Errorf("Got name %q, but expected %q", m.Name, tc.expectedNames[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,85 @@
+/*
+Copyright 2023 Preferred Networks, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fusestarter
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	// DefaultConnectTimeout is how long to wait for the CSI driver to create the fd passing socket.
+	// kubelet retries NodePublishVolume with backoff, so the socket may appear long after the container started.
+	DefaultConnectTimeout = 5 * time.Minute
+
+	connectInitialBackoff = 100 * time.Millisecond
+	connectMaxBackoff     = 5 * time.Second
+)
+
+// Dial connects to the fd passing socket sp.
+// It waits for the socket file to appear and become connectable with jittered exponential backoff until timeout elapses.
+// A zero timeout means a single attempt.
+func Dial(sp string, timeout time.Duration) (net.Conn, error) {
+	deadline := time.Now().Add(timeout)
+	backoff := connectInitialBackoff
+	for attempt := 1; ; attempt++ {
+		c, err := dialOnce(sp)
+		if err == nil {
+			if attempt > 1 {
+				klog.Infof("connected to socket %q after %d attempts", sp, attempt)
+			}
+			return c, nil
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil, fmt.Errorf("CSI driver was never reached: socket %q did not become connectable within %v: %w", sp, timeout, err)
+		}
+		if attempt == 1 {
+			klog.Infof("waiting for socket %q to become connectable: %v", sp, err)
+		} else {
+			klog.V(4).Infof("socket %q is not connectable yet: %v", sp, err)
+		}
+
+		// Jitter the delay by ±50% not to retry in lockstep with other clients.
+		//nolint:gosec
+		delay := backoff/2 + time.Duration(rand.Int63n(int64(backoff)))
+		if delay > remaining {
+			delay = remaining
+		}
+		time.Sleep(delay)
+
+		backoff *= 2
+		if backoff > connectMaxBackoff {
+			backoff = connectMaxBackoff
+		}
+	}
+}
+
+func dialOnce(sp string) (net.Conn, error) {
+	if _, err := os.Stat(sp); err != nil {
+		return nil, err
+	}
+
+	// A socket file left without a listener refuses the connection, so it is retried as well.
+	return net.Dial("unix", sp)
+}
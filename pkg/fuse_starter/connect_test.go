@@ -0,0 +1,111 @@
+/*
+Copyright 2023 Preferred Networks, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fusestarter
+
+import (
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDial(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name          string
+		listenAfter   time.Duration
+		timeout       time.Duration
+		expectedError string
+	}{
+		{
+			name:        "should connect to the socket created later",
+			listenAfter: 300 * time.Millisecond,
+			timeout:     10 * time.Second,
+		},
+		{
+			name:          "should return error for the socket not created within the timeout",
+			listenAfter:   -1,
+			timeout:       300 * time.Millisecond,
+			expectedError: "CSI driver was never reached",
+		},
+		{
+			name:          "should return error for the socket not existing without retry",
+			listenAfter:   -1,
+			timeout:       0,
+			expectedError: "CSI driver was never reached",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+
+		sp := filepath.Join(t.TempDir(), "test.sock")
+		if tc.listenAfter >= 0 {
+			time.AfterFunc(tc.listenAfter, func() {
+				l, err := net.Listen("unix", sp)
+				if err != nil {
+					t.Errorf("failed to listen on %q: %v", sp, err)
+					return
+				}
+				t.Cleanup(func() { l.Close() })
+			})
+		}
+
+		c, err := Dial(sp, tc.timeout)
+		if tc.expectedError != "" {
+			if err == nil {
+				t.Errorf("Expected error but got none")
+			} else if !strings.Contains(err.Error(), tc.expectedError) {
+				t.Errorf("Got error %q, but expected to contain %q", err, tc.expectedError)
+			}
+
+			continue
+		}
+		if err != nil {
+			t.Errorf("Did not expect error but got: %v", err)
+			continue
+		}
+		c.Close()
+	}
+}
+
+func TestPrepareMountConfigHandshakeRefused(t *testing.T) {
+	t.Parallel()
+
+	sp := filepath.Join(t.TempDir(), "test.sock")
+	l, err := net.Listen("unix", sp)
+	if err != nil {
+		t.Fatalf("failed to listen on %q: %v", sp, err)
+	}
+	defer l.Close()
+	go func() {
+		// Close the connection without sending the fd.
+		if c, err := l.Accept(); err == nil {
+			c.Close()
+		}
+	}()
+
+	_, err = PrepareMountConfig(sp, time.Second, nil)
+	if err == nil {
+		t.Fatalf("Expected error but got none")
+	}
+	if !strings.Contains(err.Error(), "CSI driver refused the handshake") {
+		t.Errorf("Got error %q, but expected the handshake to be refused", err)
+	}
+}
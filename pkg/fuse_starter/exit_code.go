@@ -0,0 +1,95 @@
+/*
+Copyright 2023 Preferred Networks, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fusestarter
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// Exit codes of fuse-starter for failures other than the mounter exiting with an error.
+// They follow sysexits.h and the shell convention, so that they are distinguishable from usual exit codes of mounters.
+const (
+	// ExitCodeUsage is for invalid command line flags or config.
+	ExitCodeUsage = 64
+	// ExitCodeHandshakeFailed is for failures to receive the FUSE fd from the CSI driver.
+	ExitCodeHandshakeFailed = 69
+	// ExitCodeHung is for the mounter killed by the watchdog.
+	ExitCodeHung = 70
+	// ExitCodeHookFailed is for a failed hook.
+	ExitCodeHookFailed = 75
+	// ExitCodeCannotExecute is for a mounter which cannot be started.
+	ExitCodeCannotExecute = 126
+	// ExitCodeNotFound is for a mounter which does not exist.
+	ExitCodeNotFound = 127
+
+	// DefaultTerminationLogPath is the default path where Kubernetes reads the termination message of a container.
+	DefaultTerminationLogPath = "/dev/termination-log"
+	// maxTerminationMessageLength is the limit of the termination message in Kubernetes.
+	maxTerminationMessageLength = 4096
+)
+
+var (
+	// ErrHandshake is wrapped by errors of the handshake with the CSI driver.
+	ErrHandshake = errors.New("failed to receive the FUSE fd from the CSI driver")
+	// ErrStartMounter is wrapped by errors of starting the mounter.
+	ErrStartMounter = errors.New("failed to start mounter")
+)
+
+// ExitCode returns the exit status reflecting how the mounter ended.
+// It follows the shell convention, 128+n for a mounter killed by signal n.
+// Failures before the mounter started are mapped to the ExitCode constants.
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+
+	var exitErr *exec.ExitError
+	switch {
+	// A hook error wraps the exit status of the hook, not the mounter.
+	case errors.Is(err, ErrHook):
+		return ExitCodeHookFailed
+	case errors.Is(err, ErrHung):
+		return ExitCodeHung
+	case errors.As(err, &exitErr):
+		if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			return 128 + int(ws.Signal())
+		}
+		return exitErr.ExitCode()
+	case errors.Is(err, ErrHandshake):
+		return ExitCodeHandshakeFailed
+	case errors.Is(err, ErrStartMounter):
+		if errors.Is(err, os.ErrNotExist) || errors.Is(err, exec.ErrNotFound) {
+			return ExitCodeNotFound
+		}
+		return ExitCodeCannotExecute
+	default:
+		return 1
+	}
+}
+
+// WriteTerminationMessage writes msg to the termination log, which is shown as the reason in the container status.
+// Too long messages are truncated to the limit of Kubernetes.
+func WriteTerminationMessage(path string, msg string) error {
+	if len(msg) > maxTerminationMessageLength {
+		msg = msg[:maxTerminationMessageLength]
+	}
+
+	return os.WriteFile(path, []byte(msg), 0o644)
+}
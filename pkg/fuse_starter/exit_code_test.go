@@ -0,0 +1,122 @@
+/*
+Copyright 2023 Preferred Networks, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fusestarter
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestExitCode(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name         string
+		script       string
+		expectedCode int
+	}{
+		{
+			name:         "should return 0 for the mounter exited normally",
+			script:       "exit 0",
+			expectedCode: 0,
+		},
+		{
+			name:         "should return the exit code of the mounter",
+			script:       "exit 3",
+			expectedCode: 3,
+		},
+		{
+			name:         "should return 128+n for the mounter killed by signal n",
+			script:       "kill -TERM $$",
+			expectedCode: 128 + int(syscall.SIGTERM),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		err := exec.Command("/bin/sh", "-c", tc.script).Run()
+		if code := ExitCode(err); code != tc.expectedCode {
+			t.Errorf("Got exit code %d, but expected %d", code, tc.expectedCode)
+		}
+	}
+}
+
+func TestExitCodeOfFailures(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name         string
+		mounterPath  string
+		socketPath   string
+		expectedCode int
+	}{
+		{
+			name:         "should return ExitCodeHandshakeFailed for the socket not connectable",
+			mounterPath:  "/bin/sh",
+			socketPath:   "/nonexistent.sock",
+			expectedCode: ExitCodeHandshakeFailed,
+		},
+		{
+			name:         "should return ExitCodeNotFound for the mounter not found",
+			mounterPath:  "/nonexistent",
+			expectedCode: ExitCodeNotFound,
+		},
+		{
+			name:         "should return ExitCodeCannotExecute for the mounter not executable",
+			mounterPath:  "/dev/null",
+			expectedCode: ExitCodeCannotExecute,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+
+		var err error
+		if tc.socketPath != "" {
+			config := MounterConfig{Name: "test-volume", FdPassingSocketPath: tc.socketPath, MounterPath: tc.mounterPath, ConnectTimeout: "0"}
+			err = NewVolume(config, SupervisorConfig{}, time.Second, false).Run()
+		} else {
+			mc, _ := newTestMountConfig(t)
+			err = NewSupervisor(New(tc.mounterPath, nil), mc, SupervisorConfig{}).Run()
+		}
+		if code := ExitCode(err); code != tc.expectedCode {
+			t.Errorf("Got exit code %d, but expected %d: %v", code, tc.expectedCode, err)
+		}
+	}
+}
+
+func TestWriteTerminationMessage(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "termination-log")
+	if err := WriteTerminationMessage(path, strings.Repeat("a", maxTerminationMessageLength+1)); err != nil {
+		t.Fatalf("Did not expect error but got: %v", err)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Did not expect error but got: %v", err)
+	}
+	if len(b) != maxTerminationMessageLength {
+		t.Errorf("Got message of %d bytes, but expected %d bytes", len(b), maxTerminationMessageLength)
+	}
+}
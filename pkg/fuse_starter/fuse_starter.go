@@ -20,21 +20,52 @@ package fusestarter
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"net"
 	"os"
 	"os/exec"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/pfnet-research/meta-fuse-csi-plugin/pkg/util"
 	"k8s.io/klog/v2"
 )
 
+const (
+	// DefaultFdNumber is the fd number of the FUSE fd in the mounter process, i.e. "/dev/fd/3".
+	DefaultFdNumber = 3
+	// MaxFdNumber limits the fd number not to pass too many closed fds to the mounter.
+	MaxFdNumber = 1023
+
+	// FdPlaceholder in the mounter args is replaced with the fd number of the FUSE fd.
+	FdPlaceholder = "{{fd}}"
+	// FdPathPlaceholder in the mounter args is replaced with the path of the FUSE fd, like "/dev/fd/3".
+	FdPathPlaceholder = "{{fd_path}}"
+
+	// captureWaitDelay bounds the wait for the output of the mounter after it exited,
+	// since orphaned children of the mounter may keep the pipes open.
+	captureWaitDelay = time.Second
+)
+
 // FuseStarter will be used in the sidecar container to invoke fuse impl.
 type FuseStarter struct {
 	mounterPath string
 	mounterArgs []string
-	Cmd         *exec.Cmd
+	// Env is the environment of the mounter. If nil, the mounter uses the environment of the current process.
+	Env []string
+	// FdNumber is the fd number of the FUSE fd in the mounter. Defaults to DefaultFdNumber.
+	FdNumber int
+	// FdEnvName is the name of the environment variable to pass the fd number to the mounter, if not empty.
+	FdEnvName string
+	// Sandbox hardens the mounter if not nil. The mounter is executed via the sandbox-exec subcommand of the running binary.
+	Sandbox *SandboxConfig
+	// UserNamespace runs the mounter in a new user namespace if not nil.
+	UserNamespace *UserNamespaceConfig
+	// LogCapture captures the output of the mounter if not nil. Otherwise, the output goes to the streams of the current process.
+	LogCapture *LogCapture
+	Cmd        *exec.Cmd
 }
 
 // New returns a FuseStarter for the current system.
@@ -50,18 +81,70 @@ func New(mounterPath string, mounterArgs []string) *FuseStarter {
 type MountConfig struct {
 	FileDescriptor int    `json:"-"`
 	VolumeName     string `json:"volumeName,omitempty"`
+	// MountPoint is the target path on the host where the CSI driver mounted the FUSE filesystem.
+	MountPoint string `json:"mountPoint,omitempty"`
+	// Token authenticates later requests, like RequestOpUnmount, of the client which received the FUSE fd.
+	Token string `json:"token,omitempty"`
 }
 
 func (m *FuseStarter) Mount(mc *MountConfig) (*exec.Cmd, error) {
 	klog.Infof("start to invoke fuse impl for volume %q", mc.VolumeName)
 
-	klog.Infof("%s mounting with args %v...", m.mounterPath, m.mounterArgs)
+	fdNumber := m.FdNumber
+	if fdNumber == 0 {
+		fdNumber = DefaultFdNumber
+	}
+	if fdNumber < DefaultFdNumber || fdNumber > MaxFdNumber {
+		return nil, fmt.Errorf("fd number %d is out of range [%d, %d]", fdNumber, DefaultFdNumber, MaxFdNumber)
+	}
+
+	args := ExpandFdPlaceholders(m.mounterArgs, fdNumber)
+	env := m.Env
+	if m.FdEnvName != "" {
+		if env == nil {
+			env = os.Environ()
+		}
+		env = append(env, fmt.Sprintf("%s=%d", m.FdEnvName, fdNumber))
+	}
+
+	path := m.mounterPath
+	cmdArgs := append([]string{m.mounterPath}, args...)
+	if m.Sandbox != nil {
+		var sandboxEnv string
+		var err error
+		if path, cmdArgs, sandboxEnv, err = sandboxCommand(m.Sandbox, m.mounterPath, args); err != nil {
+			return nil, err
+		}
+		if env == nil {
+			env = os.Environ()
+		}
+		env = append(env, sandboxEnv)
+	}
+
+	// ExtraFiles[i] becomes fd 3+i in the mounter. The nil entries before the FUSE fd are closed in the mounter.
+	extraFiles := make([]*os.File, fdNumber-DefaultFdNumber+1)
+	extraFiles[fdNumber-DefaultFdNumber] = os.NewFile(uintptr(mc.FileDescriptor), "/dev/fuse")
+
+	klog.Infof("%s mounting with args %v...", m.mounterPath, args)
 	cmd := exec.Cmd{
-		Path:       m.mounterPath,
-		Args:       append([]string{m.mounterPath}, m.mounterArgs...),
-		ExtraFiles: []*os.File{os.NewFile(uintptr(mc.FileDescriptor), "/dev/fuse")},
+		Path:       path,
+		Args:       cmdArgs,
+		Env:        env,
+		ExtraFiles: extraFiles,
 		Stdout:     os.Stdout,
 		Stderr:     os.Stderr,
+		// Put the mounter in its own process group to kill its children together.
+		SysProcAttr: &syscall.SysProcAttr{Setpgid: true},
+	}
+
+	if m.UserNamespace != nil {
+		m.UserNamespace.apply(cmd.SysProcAttr)
+	}
+
+	if m.LogCapture != nil {
+		cmd.Stdout = m.LogCapture.Writer("stdout", os.Stdout)
+		cmd.Stderr = m.LogCapture.Writer("stderr", os.Stderr)
+		cmd.WaitDelay = captureWaitDelay
 	}
 
 	m.Cmd = &cmd
@@ -69,30 +152,60 @@ func (m *FuseStarter) Mount(mc *MountConfig) (*exec.Cmd, error) {
 	return &cmd, nil
 }
 
+// ExpandFdPlaceholders replaces FdPlaceholder and FdPathPlaceholder in args with the fd number.
+func ExpandFdPlaceholders(args []string, fdNumber int) []string {
+	r := strings.NewReplacer(
+		FdPlaceholder, strconv.Itoa(fdNumber),
+		FdPathPlaceholder, fmt.Sprintf("/dev/fd/%d", fdNumber),
+	)
+
+	expanded := make([]string, 0, len(args))
+	for _, a := range args {
+		expanded = append(expanded, r.Replace(a))
+	}
+
+	return expanded
+}
+
 // Fetch the following information from a given socket path:
 // 1. Pod volume name
 // 2. The file descriptor
 // 3. Mount options passing to mounter (passed by the csi mounter).
-func PrepareMountConfig(sp string) (*MountConfig, error) {
+// It waits for the socket to become connectable up to connectTimeout.
+// options are requested to the CSI driver, which refuses them with an error wrapping ErrRefused if not allowed.
+func PrepareMountConfig(sp string, connectTimeout time.Duration, options []string) (*MountConfig, error) {
+	return requestMountConfig(sp, connectTimeout, RequestTimeout, Request{Op: RequestOpMount, Options: options})
+}
+
+// requestMountConfig sends req, which is RequestOpMount or RequestOpRemount, and receives the FUSE fd and MountConfig within timeout.
+func requestMountConfig(sp string, connectTimeout time.Duration, timeout time.Duration, req Request) (*MountConfig, error) {
 	mc := MountConfig{}
 
 	klog.Infof("connecting to socket %q", sp)
-	c, err := net.Dial("unix", sp)
+	c, err := Dial(sp, connectTimeout)
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to the socket %q: %w", sp, err)
+		return nil, err
+	}
+	// The socket is kept by the CSI driver for later requests, like RequestOpUnmount.
+	defer c.Close()
+	if err := c.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+
+	if err := sendRequest(c, req); err != nil {
+		return nil, fmt.Errorf("CSI driver refused the handshake: %w", err)
 	}
-	defer func() {
-		// as we got all the information from the socket, closing the connection and deleting the socket
-		c.Close()
-		if err = syscall.Unlink(sp); err != nil {
-			// csi driver may already removed the socket.
-			klog.Warningf("failed to close socket %q: %v", sp, err)
-		}
-	}()
 
 	fd, msg, err := util.RecvMsg(c)
+	if errors.Is(err, util.ErrNoFd) && len(msg) > 0 {
+		// The CSI driver replies with the reason instead of the fd.
+		resp := Response{}
+		if err := json.Unmarshal(msg, &resp); err == nil && resp.Error != "" {
+			return nil, fmt.Errorf("%w: %s", ErrRefused, resp.Error)
+		}
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to receive mount options from the socket %q: %w", sp, err)
+		return nil, fmt.Errorf("CSI driver refused the handshake: failed to receive mount options from the socket %q: %w", sp, err)
 	}
 
 	mc.FileDescriptor = fd
@@ -0,0 +1,109 @@
+/*
+Copyright 2023 Preferred Networks, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fusestarter
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExpandFdPlaceholders(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name         string
+		args         []string
+		fdNumber     int
+		expectedArgs []string
+	}{
+		{
+			name:         "should keep args without placeholders",
+			args:         []string{"root@localhost:/", "/dev/fd/3", "-f"},
+			fdNumber:     3,
+			expectedArgs: []string{"root@localhost:/", "/dev/fd/3", "-f"},
+		},
+		{
+			name:         "should replace placeholders",
+			args:         []string{"--fuse-fd={{fd}}", "{{fd_path}}", "-o", "fd={{fd}},ro"},
+			fdNumber:     7,
+			expectedArgs: []string{"--fuse-fd=7", "/dev/fd/7", "-o", "fd=7,ro"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		args := ExpandFdPlaceholders(tc.args, tc.fdNumber)
+		if !reflect.DeepEqual(args, tc.expectedArgs) {
+			t.Errorf("Got args %v, but expected %v", args, tc.expectedArgs)
+		}
+	}
+}
+
+func TestMountFdPlacement(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name          string
+		fdNumber      int
+		fdEnvName     string
+		script        string
+		expectedError bool
+	}{
+		{
+			name:     "should pass the FUSE fd as fd 3 by default",
+			fdNumber: 0,
+			script:   "[ -e /dev/fd/3 ]",
+		},
+		{
+			name:      "should pass the FUSE fd at the specified fd number with the environment variable",
+			fdNumber:  7,
+			fdEnvName: "FUSE_FD",
+			// fd 3 to 6 are closed in the mounter.
+			script: `[ -e {{fd_path}} ] && [ ! -e /dev/fd/3 ] && [ "$FUSE_FD" = {{fd}} ] && [ {{fd}} = 7 ]`,
+		},
+		{
+			name:          "should return error for a fd number conflicting with stdio",
+			fdNumber:      2,
+			expectedError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+
+		mc, _ := newTestMountConfig(t)
+		m := New("/bin/sh", []string{"-c", tc.script})
+		m.FdNumber = tc.fdNumber
+		m.FdEnvName = tc.fdEnvName
+
+		cmd, err := m.Mount(mc)
+		if tc.expectedError {
+			if err == nil {
+				t.Errorf("Expected error but got none")
+			}
+
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Did not expect error but got: %v", err)
+		}
+
+		if err := cmd.Run(); err != nil {
+			t.Errorf("mounter failed to find the FUSE fd: %v", err)
+		}
+	}
+}
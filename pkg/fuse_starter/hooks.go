@@ -0,0 +1,192 @@
+/*
+Copyright 2023 Preferred Networks, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fusestarter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+type HookPoint string
+
+const (
+	// HookPointPreHandshake is before connecting to the CSI driver.
+	HookPointPreHandshake HookPoint = "preHandshake"
+	// HookPointPostFdReceive is after the FUSE fd is received and before the mounter starts.
+	HookPointPostFdReceive HookPoint = "postFdReceive"
+	// HookPointPostReady is after the FUSE filesystem is confirmed ready, on every (re)start of the mounter.
+	HookPointPostReady HookPoint = "postReady"
+
+	// DefaultHookTimeout is the timeout of a hook without timeout.
+	DefaultHookTimeout = time.Minute
+)
+
+// ErrHook is wrapped by errors of failed hooks.
+var ErrHook = errors.New("hook failed")
+
+// Hook is a command run by fuse-starter at a HookPoint.
+type Hook struct {
+	Command []string `json:"command"`
+	// Timeout is like "30s". The process group of the hook is killed after it.
+	Timeout string `json:"timeout,omitempty"`
+}
+
+// HooksConfig declares hooks at each HookPoint. Hooks at a point run in order and a failing hook aborts the mount.
+type HooksConfig struct {
+	PreHandshake  []Hook `json:"preHandshake,omitempty"`
+	PostFdReceive []Hook `json:"postFdReceive,omitempty"`
+	PostReady     []Hook `json:"postReady,omitempty"`
+}
+
+// Validate checks the commands and timeouts of all hooks.
+func (c *HooksConfig) Validate() error {
+	for _, point := range []HookPoint{HookPointPreHandshake, HookPointPostFdReceive, HookPointPostReady} {
+		for i, h := range c.Hooks(point) {
+			if len(h.Command) == 0 {
+				return fmt.Errorf("%s[%d]: command is not specified", point, i)
+			}
+			if _, err := h.timeout(); err != nil {
+				return fmt.Errorf("%s[%d]: %w", point, i, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Hooks returns the hooks at point.
+func (c *HooksConfig) Hooks(point HookPoint) []Hook {
+	if c == nil {
+		return nil
+	}
+
+	switch point {
+	case HookPointPreHandshake:
+		return c.PreHandshake
+	case HookPointPostFdReceive:
+		return c.PostFdReceive
+	case HookPointPostReady:
+		return c.PostReady
+	default:
+		return nil
+	}
+}
+
+func (h *Hook) timeout() (time.Duration, error) {
+	if h.Timeout == "" {
+		return DefaultHookTimeout, nil
+	}
+
+	d, err := time.ParseDuration(h.Timeout)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timeout %q: %w", h.Timeout, err)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("timeout %q is not positive", h.Timeout)
+	}
+
+	return d, nil
+}
+
+// HookEnv returns the environment variables describing the volume for hooks.
+// mc is nil before the handshake. The token of mc is not passed, since it authenticates requests like unmount.
+func HookEnv(point HookPoint, config *MounterConfig, mc *MountConfig) ([]string, error) {
+	env := []string{
+		fmt.Sprintf("FUSE_STARTER_HOOK=%s", point),
+		fmt.Sprintf("FUSE_STARTER_NAME=%s", config.Name),
+		fmt.Sprintf("FUSE_STARTER_FD_PASSING_SOCKET_PATH=%s", config.FdPassingSocketPath),
+	}
+	if mc == nil {
+		return env, nil
+	}
+
+	public := *mc
+	public.Token = ""
+	b, err := json.Marshal(public)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal the mount config: %w", err)
+	}
+
+	return append(env,
+		fmt.Sprintf("FUSE_STARTER_VOLUME_NAME=%s", mc.VolumeName),
+		fmt.Sprintf("FUSE_STARTER_MOUNT_POINT=%s", mc.MountPoint),
+		fmt.Sprintf("FUSE_STARTER_MOUNT_CONFIG=%s", b),
+	), nil
+}
+
+// RunHooks runs hooks in order with env as the environment. It stops at the first failure.
+// The output of hooks is captured with capture, and the recent lines are included in the error.
+func RunHooks(hooks []Hook, point HookPoint, env []string, capture *LogCapture) error {
+	for i, h := range hooks {
+		if err := runHook(h, env, capture); err != nil {
+			return fmt.Errorf("%w: %s[%d] %v: %w", ErrHook, point, i, h.Command, err)
+		}
+	}
+
+	return nil
+}
+
+func runHook(h Hook, env []string, capture *LogCapture) error {
+	// The timeout is checked in HooksConfig.Validate.
+	timeout, _ := h.timeout()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	klog.Infof("running hook %v", h.Command)
+	//nolint:gosec
+	cmd := exec.CommandContext(ctx, h.Command[0], h.Command[1:]...)
+	cmd.Env = env
+	// Kill the children of the hook together on timeout.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = captureWaitDelay
+	if capture != nil {
+		capture.Reset()
+		cmd.Stdout = capture.Writer("stdout", os.Stdout)
+		cmd.Stderr = capture.Writer("stderr", os.Stderr)
+	} else {
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+	}
+
+	if err := StartChild(cmd); err != nil {
+		return err
+	}
+	err := WaitChild(cmd)
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("timed out after %v: %w", timeout, err)
+	}
+	if capture != nil {
+		capture.Flush()
+		if lines := capture.Recent(); err != nil && len(lines) > 0 {
+			err = fmt.Errorf("%w\nrecent output of hook:\n%s", err, strings.Join(lines, "\n"))
+		}
+	}
+
+	return err
+}
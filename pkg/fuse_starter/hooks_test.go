@@ -0,0 +1,175 @@
+/*
+Copyright 2023 Preferred Networks, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fusestarter
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunHooks(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name          string
+		hooks         []Hook
+		expectedError string
+	}{
+		{
+			name: "should run hooks in order with the environment",
+			hooks: []Hook{
+				{Command: []string{"/bin/sh", "-c", `[ "$FUSE_STARTER_HOOK" = preHandshake ] && [ "$FOO" = bar ]`}},
+				{Command: []string{"/bin/true"}},
+			},
+		},
+		{
+			name: "should stop at the failed hook with its output",
+			hooks: []Hook{
+				{Command: []string{"/bin/sh", "-c", "echo no credentials >&2; exit 3"}},
+				{Command: []string{"/bin/sh", "-c", "echo must not run"}},
+			},
+			expectedError: "preHandshake[0] [/bin/sh -c echo no credentials >&2; exit 3]: exit status 3\nrecent output of hook:\nstderr: no credentials",
+		},
+		{
+			name: "should succeed when the background process of the hook keeps the output open",
+			hooks: []Hook{
+				{Command: []string{"/bin/sh", "-c", "sleep 2 & exit 0"}},
+			},
+		},
+		{
+			name: "should kill the hook after the timeout",
+			hooks: []Hook{
+				{Command: []string{"/bin/sh", "-c", "sleep 60"}, Timeout: "100ms"},
+			},
+			expectedError: "timed out after 100ms",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+
+		capture := NewLogCapture("test-volume:preHandshake", LogFormatPrefix, 10)
+		env := append(os.Environ(), "FOO=bar", "FUSE_STARTER_HOOK=preHandshake")
+		start := time.Now()
+		err := RunHooks(tc.hooks, HookPointPreHandshake, env, capture)
+		if time.Since(start) > 10*time.Second {
+			t.Errorf("hooks were not killed on timeout")
+		}
+		if tc.expectedError == "" {
+			if err != nil {
+				t.Errorf("Did not expect error but got: %v", err)
+			}
+
+			continue
+		}
+		if err == nil {
+			t.Errorf("Expected error but got none")
+
+			continue
+		}
+		if !strings.Contains(err.Error(), tc.expectedError) {
+			t.Errorf("Got error %q, but expected to contain %q", err, tc.expectedError)
+		}
+		if code := ExitCode(err); code != ExitCodeHookFailed {
+			t.Errorf("Got exit code %d, but expected %d", code, ExitCodeHookFailed)
+		}
+	}
+}
+
+func TestHookEnv(t *testing.T) {
+	t.Parallel()
+
+	config := &MounterConfig{Name: "test", FdPassingSocketPath: "/fuse-fd-passing/test.sock"}
+	mc := &MountConfig{VolumeName: "test-volume", MountPoint: "/target", Token: "secret-token"}
+	env, err := HookEnv(HookPointPostFdReceive, config, mc)
+	if err != nil {
+		t.Fatalf("Did not expect error but got: %v", err)
+	}
+
+	joined := strings.Join(env, "\n")
+	if !strings.Contains(joined, `FUSE_STARTER_MOUNT_CONFIG={"volumeName":"test-volume","mountPoint":"/target"}`) {
+		t.Errorf("Got env %v, but expected the mount config without the token", env)
+	}
+	if strings.Contains(joined, mc.Token) {
+		t.Errorf("Got env %v, but expected not to contain the token", env)
+	}
+	if mc.Token != "secret-token" {
+		t.Errorf("Got token %q, but expected the mount config to be unchanged", mc.Token)
+	}
+}
+
+func TestVolumeHooks(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name           string
+		hooks          HooksConfig
+		expectedCode   int
+		expectedMarker bool
+	}{
+		{
+			name: "should run hooks before the handshake and after the fd is received",
+			hooks: HooksConfig{
+				PreHandshake: []Hook{
+					{Command: []string{"/bin/sh", "-c", `[ -z "$FUSE_STARTER_VOLUME_NAME" ] && [ "$FUSE_STARTER_NAME" = test ] && [ "$VOLUME" = test ]`}},
+				},
+				PostFdReceive: []Hook{
+					{Command: []string{"/bin/sh", "-c", `[ "$FUSE_STARTER_VOLUME_NAME" = test-volume ] && echo "$FUSE_STARTER_MOUNT_CONFIG" | grep -q '"mountPoint":"/target"' && touch "$MARKER"`}},
+				},
+			},
+			expectedCode:   0,
+			expectedMarker: true,
+		},
+		{
+			name: "should abort the mount when a hook failed",
+			hooks: HooksConfig{
+				PostFdReceive: []Hook{
+					{Command: []string{"/bin/false"}},
+				},
+			},
+			expectedCode: ExitCodeHookFailed,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+
+		dir := t.TempDir()
+		marker := filepath.Join(dir, "marker")
+		config := MounterConfig{
+			Name:                "test",
+			FdPassingSocketPath: filepath.Join(dir, "test.sock"),
+			MounterPath:         "/bin/sh",
+			// The mounter runs only after the hooks succeeded.
+			Args:  []string{"-c", `[ -e "$MARKER" ]`},
+			Env:   map[string]string{"VOLUME": "test", "MARKER": marker},
+			Hooks: &tc.hooks,
+		}
+		serveFd(t, config.FdPassingSocketPath, MountConfig{VolumeName: "test-volume", MountPoint: "/target"})
+
+		err := NewVolume(config, SupervisorConfig{}, 0, false).Run()
+		if code := ExitCode(err); code != tc.expectedCode {
+			t.Errorf("Got exit code %d, but expected %d: %v", code, tc.expectedCode, err)
+		}
+		if _, err := os.Stat(marker); (err == nil) != tc.expectedMarker {
+			t.Errorf("Got marker existence %v, but expected %v", err == nil, tc.expectedMarker)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+/*
+Copyright 2023 Preferred Networks, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fusestarter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+type LogFormat string
+
+const (
+	// LogFormatRaw writes each line of the mounter output as is.
+	LogFormatRaw LogFormat = "raw"
+	// LogFormatPrefix prefixes each line of the mounter output with the volume name.
+	LogFormatPrefix LogFormat = "prefix"
+	// LogFormatJSON writes each line of the mounter output as a JSON object.
+	LogFormatJSON LogFormat = "json"
+
+	// DefaultLogBufferLines is the number of recent lines of the mounter output kept in memory.
+	DefaultLogBufferLines = 50
+	// maxLogLineLength splits too long lines not to buffer an unbounded amount of output.
+	maxLogLineLength = 16 * 1024
+)
+
+// ParseLogFormat returns the LogFormat of s. An empty string means LogFormatRaw.
+func ParseLogFormat(s string) (LogFormat, error) {
+	switch LogFormat(s) {
+	case "", LogFormatRaw:
+		return LogFormatRaw, nil
+	case LogFormatPrefix:
+		return LogFormatPrefix, nil
+	case LogFormatJSON:
+		return LogFormatJSON, nil
+	default:
+		return "", fmt.Errorf("unknown log format %q", s)
+	}
+}
+
+// logEntry is a line of the mounter output in LogFormatJSON.
+type logEntry struct {
+	Time   time.Time `json:"time"`
+	Volume string    `json:"volume"`
+	Stream string    `json:"stream"`
+	Msg    string    `json:"msg"`
+}
+
+// LogCapture captures the output of the mounter line by line.
+// It writes the lines in the format, e.g. with the volume name, and keeps the recent lines in a ring buffer.
+type LogCapture struct {
+	name   string
+	format LogFormat
+
+	mu      sync.Mutex
+	ring    []string
+	next    int
+	full    bool
+	writers map[string]*lineWriter
+}
+
+// NewLogCapture returns a LogCapture keeping bufferLines recent lines.
+func NewLogCapture(name string, format LogFormat, bufferLines int) *LogCapture {
+	if bufferLines < 0 {
+		bufferLines = 0
+	}
+
+	return &LogCapture{
+		name:    name,
+		format:  format,
+		ring:    make([]string, bufferLines),
+		writers: map[string]*lineWriter{},
+	}
+}
+
+// Writer returns a writer for the stream of the mounter, like "stdout", writing the formatted lines to out.
+// It replaces the previous writer for the stream, e.g. of the mounter before restart.
+func (c *LogCapture) Writer(stream string, out io.Writer) io.Writer {
+	c.mu.Lock()
+	prev := c.writers[stream]
+	w := &lineWriter{capture: c, stream: stream, out: out}
+	c.writers[stream] = w
+	c.mu.Unlock()
+
+	if prev != nil {
+		prev.flush()
+	}
+
+	return w
+}
+
+// Flush writes the incomplete last lines. It should be called after the mounter exited.
+func (c *LogCapture) Flush() {
+	c.mu.Lock()
+	writers := make([]*lineWriter, 0, len(c.writers))
+	for _, w := range c.writers {
+		writers = append(writers, w)
+	}
+	c.mu.Unlock()
+
+	for _, w := range writers {
+		w.flush()
+	}
+}
+
+// Recent returns the recent lines in order, prefixed with the stream.
+func (c *LogCapture) Recent() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.full {
+		return append([]string{}, c.ring[:c.next]...)
+	}
+
+	return append(append([]string{}, c.ring[c.next:]...), c.ring[:c.next]...)
+}
+
+// Reset clears the recent lines, e.g. before the mounter is restarted.
+func (c *LogCapture) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.next = 0
+	c.full = false
+}
+
+func (c *LogCapture) writeLine(stream string, out io.Writer, line string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.ring) > 0 {
+		c.ring[c.next] = fmt.Sprintf("%s: %s", stream, line)
+		c.next = (c.next + 1) % len(c.ring)
+		if c.next == 0 {
+			c.full = true
+		}
+	}
+
+	// Write under the lock not to interleave lines of stdout and stderr.
+	switch c.format {
+	case LogFormatJSON:
+		b, err := json.Marshal(logEntry{
+			Time:   time.Now(),
+			Volume: c.name,
+			Stream: stream,
+			Msg:    line,
+		})
+		if err != nil {
+			return
+		}
+		//nolint:errcheck
+		out.Write(append(b, '\n'))
+	case LogFormatPrefix:
+		fmt.Fprintf(out, "[%s] %s\n", c.name, line)
+	default:
+		fmt.Fprintln(out, line)
+	}
+}
+
+// lineWriter splits the output into lines for LogCapture.
+type lineWriter struct {
+	capture *LogCapture
+	stream  string
+	out     io.Writer
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			if len(w.buf) >= maxLogLineLength {
+				w.capture.writeLine(w.stream, w.out, string(w.buf))
+				w.buf = w.buf[:0]
+			}
+			break
+		}
+		w.capture.writeLine(w.stream, w.out, string(bytes.TrimSuffix(w.buf[:i], []byte{'\r'})))
+		w.buf = w.buf[i+1:]
+	}
+
+	return len(p), nil
+}
+
+func (w *lineWriter) flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.buf) > 0 {
+		w.capture.writeLine(w.stream, w.out, string(w.buf))
+		w.buf = w.buf[:0]
+	}
+}
@@ -0,0 +1,162 @@
+/*
+Copyright 2023 Preferred Networks, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fusestarter
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLogCapture(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name           string
+		format         LogFormat
+		bufferLines    int
+		writes         []string
+		expectedOutput string
+		expectedRecent []string
+	}{
+		{
+			name:           "should prefix lines with the volume name",
+			format:         LogFormatPrefix,
+			bufferLines:    10,
+			writes:         []string{"hello\nwor", "ld\r\n", "no newline"},
+			expectedOutput: "[vol] hello\n[vol] world\n[vol] no newline\n",
+			expectedRecent: []string{"stderr: hello", "stderr: world", "stderr: no newline"},
+		},
+		{
+			name:           "should write lines as is",
+			format:         LogFormatRaw,
+			bufferLines:    10,
+			writes:         []string{"hello\nwor", "ld\r\n"},
+			expectedOutput: "hello\nworld\n",
+			expectedRecent: []string{"stderr: hello", "stderr: world"},
+		},
+		{
+			name:           "should keep only the recent lines",
+			format:         LogFormatPrefix,
+			bufferLines:    2,
+			writes:         []string{"1\n2\n3\n4\n"},
+			expectedOutput: "[vol] 1\n[vol] 2\n[vol] 3\n[vol] 4\n",
+			expectedRecent: []string{"stderr: 3", "stderr: 4"},
+		},
+		{
+			name:           "should keep no lines without buffer",
+			format:         LogFormatPrefix,
+			bufferLines:    0,
+			writes:         []string{"1\n"},
+			expectedOutput: "[vol] 1\n",
+			expectedRecent: []string{},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+
+		out := bytes.Buffer{}
+		c := NewLogCapture("vol", tc.format, tc.bufferLines)
+		w := c.Writer("stderr", &out)
+		for _, s := range tc.writes {
+			if _, err := w.Write([]byte(s)); err != nil {
+				t.Fatalf("Did not expect error but got: %v", err)
+			}
+		}
+		c.Flush()
+
+		if out.String() != tc.expectedOutput {
+			t.Errorf("Got output %q, but expected %q", out.String(), tc.expectedOutput)
+		}
+		if recent := c.Recent(); !reflect.DeepEqual(recent, tc.expectedRecent) {
+			t.Errorf("Got recent lines %q, but expected %q", recent, tc.expectedRecent)
+		}
+	}
+}
+
+func TestLogCaptureJSON(t *testing.T) {
+	t.Parallel()
+
+	out := bytes.Buffer{}
+	c := NewLogCapture("vol", LogFormatJSON, 10)
+	//nolint:errcheck
+	c.Writer("stdout", &out).Write([]byte("hello \"world\"\n"))
+
+	entry := logEntry{}
+	if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+		t.Fatalf("Did not expect error but got: %v", err)
+	}
+	if entry.Volume != "vol" || entry.Stream != "stdout" || entry.Msg != "hello \"world\"" {
+		t.Errorf("Got unexpected entry %+v", entry)
+	}
+}
+
+func TestSupervisorErrorWithRecentOutput(t *testing.T) {
+	t.Parallel()
+
+	mc, _ := newTestMountConfig(t)
+	m := New("/bin/sh", []string{"-c", "echo starting >&2; echo 'fuse: bad mount point' >&2; exit 1"})
+	m.LogCapture = NewLogCapture("vol", LogFormatPrefix, 10)
+
+	err := NewSupervisor(m, mc, SupervisorConfig{}).Run()
+	if err == nil {
+		t.Fatalf("Expected error but got none")
+	}
+	if !strings.Contains(err.Error(), "stderr: starting\nstderr: fuse: bad mount point") {
+		t.Errorf("Got error %q, but expected to contain the recent output", err)
+	}
+	if code := ExitCode(err); code != 1 {
+		t.Errorf("Got exit code %d, but expected 1", code)
+	}
+}
+
+func TestParseLogFormat(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name           string
+		format         string
+		expectedFormat LogFormat
+		expectedError  bool
+	}{
+		{name: "should default to raw", format: "", expectedFormat: LogFormatRaw},
+		{name: "should parse prefix", format: "prefix", expectedFormat: LogFormatPrefix},
+		{name: "should parse json", format: "json", expectedFormat: LogFormatJSON},
+		{name: "should return error for unknown format", format: "yaml", expectedError: true},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		format, err := ParseLogFormat(tc.format)
+		if tc.expectedError {
+			if err == nil {
+				t.Errorf("Expected error but got none")
+			}
+
+			continue
+		}
+		if err != nil {
+			t.Errorf("Did not expect error but got: %v", err)
+		}
+		if format != tc.expectedFormat {
+			t.Errorf("Got format %q, but expected %q", format, tc.expectedFormat)
+		}
+	}
+}
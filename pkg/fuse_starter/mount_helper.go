@@ -0,0 +1,237 @@
+/*
+Copyright 2023 Preferred Networks, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fusestarter
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// MountHelperCommand is the subcommand of fuse-starter accepting the command line of mount.fuse3.
+	// fuse-starter also behaves as the mount helper when it is invoked as mount.fuse3, mount.fuse or mount.fuse.<type>.
+	MountHelperCommand = "mount.fuse3"
+)
+
+// mountHelperNames are the names of the mount helpers of libfuse3 and libfuse2.
+var mountHelperNames = []string{"mount.fuse3", "mount.fuse"}
+
+// kernelMountOptions are requested to the CSI driver, which decides whether to allow them.
+// The other options are only passed to the FUSE daemon.
+var kernelMountOptions = map[string]bool{
+	"ro":                  true,
+	"rw":                  true,
+	"suid":                true,
+	"nosuid":              true,
+	"dev":                 true,
+	"nodev":               true,
+	"exec":                true,
+	"noexec":              true,
+	"atime":               true,
+	"noatime":             true,
+	"sync":                true,
+	"async":               true,
+	"dirsync":             true,
+	"allow_other":         true,
+	"default_permissions": true,
+}
+
+// helperOnlyMountOptions are for mount(8) and fstab, and not passed to anywhere like mount.fuse3.
+var helperOnlyMountOptions = map[string]bool{
+	"defaults": true,
+	"_netdev":  true,
+	"nofail":   true,
+	"auto":     true,
+	"noauto":   true,
+	"user":     true,
+	"nouser":   true,
+	"users":    true,
+	"owner":    true,
+}
+
+// MountHelperArgs is the command line of mount.fuse3 translated for fd passing.
+type MountHelperArgs struct {
+	// Type is the FUSE daemon to execute, like "sshfs".
+	Type       string
+	Source     string
+	MountPoint string
+	// DriverOptions are requested to the CSI driver on the handshake.
+	DriverOptions []string
+	// DaemonOptions are passed to the FUSE daemon with "-o".
+	DaemonOptions []string
+}
+
+// IsMountHelper returns true if progName, the base name of argv[0], is the name of a mount helper of FUSE.
+func IsMountHelper(progName string) bool {
+	for _, name := range mountHelperNames {
+		if progName == name || strings.HasPrefix(progName, name+".") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ParseMountHelperArgs parses args in the grammar of mount.fuse3,
+// "type#[source] mountpoint [-o options]" or "[source] mountpoint -t type [-o options]".
+// The type may also be given by progName, like "mount.fuse.sshfs" invoked by "mount -t fuse.sshfs".
+func ParseMountHelperArgs(progName string, args []string) (*MountHelperArgs, error) {
+	a := &MountHelperArgs{}
+	for _, name := range mountHelperNames {
+		if strings.HasPrefix(progName, name+".") {
+			a.Type = strings.TrimPrefix(progName, name+".")
+			break
+		}
+	}
+
+	positional := []string{}
+	options := []string{}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "-o" || arg == "-t":
+			if i+1 >= len(args) {
+				return nil, fmt.Errorf("missing argument of %s", arg)
+			}
+			i++
+			if arg == "-o" {
+				options = append(options, strings.Split(args[i], ",")...)
+			} else {
+				a.Type = trimFuseType(args[i])
+			}
+		case strings.HasPrefix(arg, "-o"):
+			options = append(options, strings.Split(arg[2:], ",")...)
+		case arg == "-n" || arg == "-s" || arg == "-v":
+			// The flags of mount(8) for mount helpers are not relevant.
+		case strings.HasPrefix(arg, "-"):
+			return nil, fmt.Errorf("unknown option %q", arg)
+		default:
+			positional = append(positional, arg)
+		}
+	}
+
+	switch len(positional) {
+	case 1:
+		a.MountPoint = positional[0]
+	case 2:
+		a.Source = positional[0]
+		a.MountPoint = positional[1]
+	default:
+		return nil, fmt.Errorf("expected [type#][source] and mountpoint, but got %q", positional)
+	}
+
+	if t, source, ok := strings.Cut(a.Source, "#"); ok {
+		a.Type = t
+		a.Source = source
+	}
+	if a.Type == "" {
+		return nil, fmt.Errorf("type of the FUSE filesystem is not specified")
+	}
+	// The type and the source are requested to the CSI driver as "subtype=" and "fsname=".
+	// The type is also looked up in PATH.
+	if err := ValidateSubtype(a.Type); err != nil {
+		return nil, fmt.Errorf("type %q is invalid: %w", a.Type, err)
+	}
+	if a.Source != "" {
+		if err := ValidateFsname(a.Source); err != nil {
+			return nil, fmt.Errorf("source %q is invalid: %w", a.Source, err)
+		}
+	}
+
+	for _, o := range options {
+		name, _, _ := strings.Cut(o, "=")
+		switch {
+		case o == "" || helperOnlyMountOptions[o] || strings.HasPrefix(o, "x-") || strings.HasPrefix(o, "comment="):
+		case name == "setuid" || o == "drop_privileges":
+			return nil, fmt.Errorf("option %q is not supported. Use the sandbox of fuse-starter instead", o)
+		case kernelMountOptions[o] || name == "max_read":
+			a.DriverOptions = append(a.DriverOptions, o)
+			a.DaemonOptions = append(a.DaemonOptions, o)
+		default:
+			a.DaemonOptions = append(a.DaemonOptions, o)
+		}
+	}
+	// Show the type and the source in the mount table like libfuse.
+	a.DriverOptions = append(a.DriverOptions, fmt.Sprintf("subtype=%s", a.Type))
+	if a.Source != "" {
+		a.DriverOptions = append(a.DriverOptions, fmt.Sprintf("fsname=%s", a.Source))
+	}
+
+	return a, nil
+}
+
+// trimFuseType returns the type of the FUSE daemon from the filesystem type of mount(8), like "fuse.sshfs".
+func trimFuseType(t string) string {
+	for _, prefix := range []string{"fuse.", "fuse3.", "fuseblk."} {
+		if strings.HasPrefix(t, prefix) {
+			return strings.TrimPrefix(t, prefix)
+		}
+	}
+
+	return t
+}
+
+// DaemonArgs returns the args of the FUSE daemon mounting the FUSE fd at fdNumber.
+func (a *MountHelperArgs) DaemonArgs(fdNumber int) []string {
+	args := []string{}
+	if a.Source != "" {
+		args = append(args, a.Source)
+	}
+	args = append(args, fmt.Sprintf("/dev/fd/%d", fdNumber))
+	if len(a.DaemonOptions) > 0 {
+		args = append(args, "-o", strings.Join(a.DaemonOptions, ","))
+	}
+
+	return args
+}
+
+// RunMountHelper receives the FUSE fd from the CSI driver via the socket sp with the translated options,
+// and executes the FUSE daemon in place of the current process. It returns only on failure.
+func RunMountHelper(a *MountHelperArgs, sp string, connectTimeout time.Duration) error {
+	daemonPath, err := exec.LookPath(a.Type)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrStartMounter, err)
+	}
+
+	mc, err := PrepareMountConfig(sp, connectTimeout, a.DriverOptions)
+	if err != nil {
+		return fmt.Errorf("%w: socket path %q: %w", ErrHandshake, sp, err)
+	}
+
+	// The received fd is close-on-exec. Clear it to pass the fd to the daemon.
+	if _, err := unix.FcntlInt(uintptr(mc.FileDescriptor), unix.F_SETFD, 0); err != nil {
+		syscall.Close(mc.FileDescriptor)
+		return fmt.Errorf("%w: failed to clear close-on-exec of the FUSE fd: %w", ErrStartMounter, err)
+	}
+	args := append([]string{a.Type}, a.DaemonArgs(mc.FileDescriptor)...)
+	klog.Infof("executing %s with args %v for volume %q", daemonPath, args[1:], mc.VolumeName)
+	klog.Flush()
+	//nolint:gosec
+	if err := syscall.Exec(daemonPath, args, os.Environ()); err != nil {
+		syscall.Close(mc.FileDescriptor)
+		return fmt.Errorf("%w: %w", ErrStartMounter, err)
+	}
+
+	return nil
+}
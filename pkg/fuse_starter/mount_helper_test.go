@@ -0,0 +1,220 @@
+/*
+Copyright 2023 Preferred Networks, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fusestarter
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestIsMountHelper(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name     string
+		progName string
+		expected bool
+	}{
+		{name: "should accept mount.fuse3", progName: "mount.fuse3", expected: true},
+		{name: "should accept mount.fuse", progName: "mount.fuse", expected: true},
+		{name: "should accept mount.fuse.<type>", progName: "mount.fuse.sshfs", expected: true},
+		{name: "should accept mount.fuse3.<type>", progName: "mount.fuse3.sshfs", expected: true},
+		{name: "should reject fuse-starter", progName: "fuse-starter", expected: false},
+		{name: "should reject mount.fuseblk", progName: "mount.fuseblk", expected: false},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+
+		if got := IsMountHelper(tc.progName); got != tc.expected {
+			t.Errorf("Got %v, but expected %v", got, tc.expected)
+		}
+	}
+}
+
+func TestParseMountHelperArgs(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name          string
+		progName      string
+		args          []string
+		expected      *MountHelperArgs
+		expectedError bool
+	}{
+		{
+			name:     "should parse type#source",
+			progName: "mount.fuse3",
+			args:     []string{"sshfs#user@host:/dir", "/mnt", "-o", "ro,reconnect"},
+			expected: &MountHelperArgs{
+				Type:          "sshfs",
+				Source:        "user@host:/dir",
+				MountPoint:    "/mnt",
+				DriverOptions: []string{"ro", "subtype=sshfs", "fsname=user@host:/dir"},
+				DaemonOptions: []string{"ro", "reconnect"},
+			},
+		},
+		{
+			name:     "should parse type# without source",
+			progName: "mount.fuse3",
+			args:     []string{"goofys#", "/mnt"},
+			expected: &MountHelperArgs{
+				Type:          "goofys",
+				MountPoint:    "/mnt",
+				DriverOptions: []string{"subtype=goofys"},
+			},
+		},
+		{
+			name:     "should take the type from -t of mount(8)",
+			progName: "mount.fuse3",
+			args:     []string{"user@host:/dir", "/mnt", "-n", "-t", "fuse.sshfs", "-onoatime,max_read=65536"},
+			expected: &MountHelperArgs{
+				Type:          "sshfs",
+				Source:        "user@host:/dir",
+				MountPoint:    "/mnt",
+				DriverOptions: []string{"noatime", "max_read=65536", "subtype=sshfs", "fsname=user@host:/dir"},
+				DaemonOptions: []string{"noatime", "max_read=65536"},
+			},
+		},
+		{
+			name:     "should take the type from the program name",
+			progName: "mount.fuse.sshfs",
+			args:     []string{"user@host:/dir", "/mnt"},
+			expected: &MountHelperArgs{
+				Type:          "sshfs",
+				Source:        "user@host:/dir",
+				MountPoint:    "/mnt",
+				DriverOptions: []string{"subtype=sshfs", "fsname=user@host:/dir"},
+			},
+		},
+		{
+			name:     "should drop options only for mount(8)",
+			progName: "mount.fuse3",
+			args:     []string{"sshfs#host:", "/mnt", "-o", "defaults,_netdev,nofail,noauto,x-systemd.automount,comment=foo,idmap=user"},
+			expected: &MountHelperArgs{
+				Type:          "sshfs",
+				Source:        "host:",
+				MountPoint:    "/mnt",
+				DriverOptions: []string{"subtype=sshfs", "fsname=host:"},
+				DaemonOptions: []string{"idmap=user"},
+			},
+		},
+		{
+			name:          "should return error for setuid",
+			progName:      "mount.fuse3",
+			args:          []string{"sshfs#host:", "/mnt", "-o", "setuid=user"},
+			expectedError: true,
+		},
+		{
+			name:          "should return error without type",
+			progName:      "mount.fuse3",
+			args:          []string{"host:", "/mnt"},
+			expectedError: true,
+		},
+		{
+			name:          "should return error for a type with a path",
+			progName:      "mount.fuse3",
+			args:          []string{"../sshfs#host:", "/mnt"},
+			expectedError: true,
+		},
+		{
+			name:          "should return error for a source taken as an option of mount(8)",
+			progName:      "mount.fuse3",
+			args:          []string{"sshfs#--bind", "/mnt"},
+			expectedError: true,
+		},
+		{
+			name:          "should return error for a source with a comma",
+			progName:      "mount.fuse3",
+			args:          []string{"sshfs#host:/a,suid", "/mnt"},
+			expectedError: true,
+		},
+		{
+			name:          "should return error for a type with a comma",
+			progName:      "mount.fuse3",
+			args:          []string{"host:", "/mnt", "-t", "fuse.sshfs,ext4"},
+			expectedError: true,
+		},
+		{
+			name:          "should return error without mountpoint",
+			progName:      "mount.fuse3",
+			args:          []string{"-t", "sshfs"},
+			expectedError: true,
+		},
+		{
+			name:          "should return error for -o without options",
+			progName:      "mount.fuse3",
+			args:          []string{"sshfs#host:", "/mnt", "-o"},
+			expectedError: true,
+		},
+		{
+			name:          "should return error for an unknown flag",
+			progName:      "mount.fuse3",
+			args:          []string{"sshfs#host:", "/mnt", "-x"},
+			expectedError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+
+		a, err := ParseMountHelperArgs(tc.progName, tc.args)
+		if tc.expectedError {
+			if err == nil {
+				t.Errorf("Expected error but got none")
+			}
+
+			continue
+		}
+		if err != nil {
+			t.Errorf("Did not expect error but got: %v", err)
+			continue
+		}
+		if !reflect.DeepEqual(a, tc.expected) {
+			t.Errorf("Got %+v, but expected %+v", a, tc.expected)
+		}
+	}
+}
+
+func TestMountHelperDaemonArgs(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name     string
+		args     *MountHelperArgs
+		expected []string
+	}{
+		{
+			name:     "should pass the source, the fd path and the options",
+			args:     &MountHelperArgs{Type: "sshfs", Source: "host:", DaemonOptions: []string{"ro", "reconnect"}},
+			expected: []string{"host:", "/dev/fd/5", "-o", "ro,reconnect"},
+		},
+		{
+			name:     "should omit the source and the options",
+			args:     &MountHelperArgs{Type: "goofys"},
+			expected: []string{"/dev/fd/5"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+
+		if got := tc.args.DaemonArgs(5); !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("Got %v, but expected %v", got, tc.expected)
+		}
+	}
+}
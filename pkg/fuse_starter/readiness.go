@@ -0,0 +1,216 @@
+/*
+Copyright 2023 Preferred Networks, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fusestarter
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"k8s.io/klog/v2"
+	"k8s.io/mount-utils"
+)
+
+const (
+	// FuseSuperMagic is the filesystem type of FUSE in statfs(2).
+	FuseSuperMagic = 0x65735546
+
+	mountInfoPath = "/proc/self/mountinfo"
+)
+
+// Readiness tracks whether the FUSE filesystem answers filesystem operations,
+// and signals it via a ready file.
+type Readiness struct {
+	mu        sync.Mutex
+	ready     bool
+	readyFile string
+}
+
+// NewReadiness returns a Readiness. The ready file exists while it is ready.
+// An empty readyFile disables the file.
+func NewReadiness(readyFile string) *Readiness {
+	return &Readiness{
+		readyFile: readyFile,
+	}
+}
+
+func (r *Readiness) Set(ready bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.ready == ready {
+		return
+	}
+	r.ready = ready
+
+	if r.readyFile == "" {
+		return
+	}
+	if ready {
+		if err := os.WriteFile(r.readyFile, []byte{}, 0o644); err != nil {
+			klog.Warningf("failed to create ready file %q: %v", r.readyFile, err)
+		}
+	} else {
+		if err := os.Remove(r.readyFile); err != nil && !os.IsNotExist(err) {
+			klog.Warningf("failed to remove ready file %q: %v", r.readyFile, err)
+		}
+	}
+}
+
+func (r *Readiness) Ready() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.ready
+}
+
+// ServeHTTP responds 200 when ready, otherwise 503.
+func (r *Readiness) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	if r.Ready() {
+		fmt.Fprintln(w, "ok")
+		return
+	}
+	http.Error(w, "not ready", http.StatusServiceUnavailable)
+}
+
+// FindMountPoint returns the path where the FUSE filesystem described by mc is visible in this container.
+// mc.MountPoint is the target path on the host, which is usually not visible in containers.
+// Thus, it looks for the FUSE mount whose source is the volume name in the mount table.
+func FindMountPoint(mc *MountConfig) (string, error) {
+	mis, err := mount.ParseMountInfo(mountInfoPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse %q: %w", mountInfoPath, err)
+	}
+
+	found := ""
+	for _, mi := range mis {
+		if mi.FsType != "fuse" && !strings.HasPrefix(mi.FsType, "fuse.") {
+			continue
+		}
+		if mc.MountPoint != "" && filepath.Clean(mi.MountPoint) == filepath.Clean(mc.MountPoint) {
+			return mi.MountPoint, nil
+		}
+		// subPath volume mounts have a different root. Prefer the one mounting the whole volume.
+		if mi.Source == mc.VolumeName && (found == "" || mi.Root == "/") {
+			found = mi.MountPoint
+		}
+	}
+	if found == "" {
+		return "", fmt.Errorf("FUSE mount of volume %q is not found in this container", mc.VolumeName)
+	}
+
+	return found, nil
+}
+
+// ProbeMount checks that the FUSE daemon answers statfs(2) on path within timeout.
+// statfs(2) on FUSE blocks until the daemon replied to FUSE_INIT.
+// A hung FUSE daemon blocks it forever, so a new probe is not started on path while the previous one is blocked.
+func ProbeMount(path string, timeout time.Duration) error {
+	return defaultMountProber.probe(path, timeout)
+}
+
+var defaultMountProber = newMountProber(syscall.Statfs)
+
+// mountProber runs statfs(2) on FUSE filesystems in other goroutines, keeping one in flight per path.
+type mountProber struct {
+	statfs func(path string, st *syscall.Statfs_t) error
+
+	mu sync.Mutex
+	// pending are the probes not returned yet. key is the path.
+	pending map[string]*mountProbe
+}
+
+// mountProbe is the result of a probe, which is set before done is closed.
+type mountProbe struct {
+	done chan struct{}
+	err  error
+}
+
+func newMountProber(statfs func(path string, st *syscall.Statfs_t) error) *mountProber {
+	return &mountProber{
+		statfs:  statfs,
+		pending: map[string]*mountProbe{},
+	}
+}
+
+func (p *mountProber) probe(path string, timeout time.Duration) error {
+	pr := p.start(path)
+	select {
+	case <-pr.done:
+		return pr.err
+	case <-time.After(timeout):
+		return fmt.Errorf("statfs on %q did not return within %v", path, timeout)
+	}
+}
+
+// start returns the pending probe on path, or starts a new one.
+func (p *mountProber) start(path string) *mountProbe {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if pr, ok := p.pending[path]; ok {
+		return pr
+	}
+	pr := &mountProbe{done: make(chan struct{})}
+	p.pending[path] = pr
+	go func() {
+		var st syscall.Statfs_t
+		if err := p.statfs(path, &st); err != nil {
+			pr.err = err
+		} else if st.Type != FuseSuperMagic {
+			// The FUSE mount is not propagated to the container yet.
+			pr.err = fmt.Errorf("%q is not FUSE (filesystem type 0x%x)", path, st.Type)
+		}
+		p.mu.Lock()
+		delete(p.pending, path)
+		p.mu.Unlock()
+		close(pr.done)
+	}()
+
+	return pr
+}
+
+// WaitForMount probes the FUSE filesystem every interval until it answers or stopCh is closed,
+// and returns the path where it answered.
+// If mountPoint is empty, it is looked up with FindMountPoint.
+func WaitForMount(mc *MountConfig, mountPoint string, interval time.Duration, stopCh <-chan struct{}) (string, error) {
+	for {
+		path := mountPoint
+		var err error
+		if path == "" {
+			path, err = FindMountPoint(mc)
+		}
+		if err == nil {
+			if err = ProbeMount(path, interval); err == nil {
+				klog.Infof("[%v] FUSE filesystem at %q is ready", mc.VolumeName, path)
+				return path, nil
+			}
+		}
+		klog.V(4).Infof("[%v] FUSE filesystem is not ready: %v", mc.VolumeName, err)
+
+		select {
+		case <-time.After(interval):
+		case <-stopCh:
+			return "", fmt.Errorf("stopped waiting for FUSE filesystem of volume %q: %w", mc.VolumeName, err)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+/*
+Copyright 2023 Preferred Networks, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fusestarter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestReadiness(t *testing.T) {
+	t.Parallel()
+
+	readyFile := filepath.Join(t.TempDir(), "ready")
+	r := NewReadiness(readyFile)
+
+	for _, ready := range []bool{true, false, true} {
+		r.Set(ready)
+
+		if _, err := os.Stat(readyFile); (err == nil) != ready {
+			t.Errorf("ready file exists=%v, but expected %v", err == nil, ready)
+		}
+
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ready", nil))
+		expectedCode := http.StatusServiceUnavailable
+		if ready {
+			expectedCode = http.StatusOK
+		}
+		if rec.Code != expectedCode {
+			t.Errorf("Got status code %d, but expected %d", rec.Code, expectedCode)
+		}
+	}
+}
+
+func TestProbeMountRejectsNonFuse(t *testing.T) {
+	t.Parallel()
+
+	// The FUSE mount may not be propagated to the container yet, and the probe must not pass on the underlying directory.
+	if err := ProbeMount(t.TempDir(), time.Second); err == nil {
+		t.Errorf("Expected error but got none")
+	}
+}
+
+func TestMountProberReusesPendingProbe(t *testing.T) {
+	t.Parallel()
+
+	var calls atomic.Int32
+	unblock := make(chan struct{})
+	p := newMountProber(func(_ string, st *syscall.Statfs_t) error {
+		calls.Add(1)
+		<-unblock
+		st.Type = FuseSuperMagic
+		return nil
+	})
+
+	// The hung probe is reused instead of leaking a goroutine per probe.
+	for i := 0; i < 3; i++ {
+		if err := p.probe("/data", 10*time.Millisecond); err == nil {
+			t.Errorf("Expected error but got none")
+		}
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("Got %d probes, but expected 1", n)
+	}
+
+	close(unblock)
+	if err := p.probe("/data", time.Second); err != nil {
+		t.Errorf("Did not expect error but got: %v", err)
+	}
+	// A probe returned is not reused.
+	if err := p.probe("/data", time.Second); err != nil {
+		t.Errorf("Did not expect error but got: %v", err)
+	}
+	if n := calls.Load(); n != 2 {
+		t.Errorf("Got %d probes, but expected 2", n)
+	}
+}
+
+func TestWaitForMountStops(t *testing.T) {
+	t.Parallel()
+
+	stopCh := make(chan struct{})
+	close(stopCh)
+	if _, err := WaitForMount(&MountConfig{VolumeName: "test-volume"}, t.TempDir(), 10*time.Millisecond, stopCh); err == nil {
+		t.Errorf("Expected error but got none")
+	}
+}
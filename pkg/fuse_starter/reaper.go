@@ -0,0 +1,149 @@
+/*
+Copyright 2023 Preferred Networks, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fusestarter
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/unix"
+	"k8s.io/klog/v2"
+)
+
+// children holds the pids of the processes started with StartChild.
+// The reaper must not reap them, otherwise exec.Cmd.Wait fails with ECHILD.
+var children = struct {
+	sync.Mutex
+	pids map[int]bool
+}{pids: map[int]bool{}}
+
+// StartChild starts cmd and registers it as a child waited by WaitChild.
+func StartChild(cmd *exec.Cmd) error {
+	// Hold the lock until the pid is registered, so that the reaper cannot reap the child exiting immediately.
+	children.Lock()
+	defer children.Unlock()
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	children.pids[cmd.Process.Pid] = true
+
+	return nil
+}
+
+// WaitChild waits for the child started with StartChild.
+// A child exiting successfully is not an error even if its output was held open by its background processes past cmd.WaitDelay.
+func WaitChild(cmd *exec.Cmd) error {
+	err := cmd.Wait()
+	if errors.Is(err, exec.ErrWaitDelay) && cmd.ProcessState.Success() {
+		klog.Warningf("process %d exited successfully but its output was not closed within %v: %v", cmd.Process.Pid, cmd.WaitDelay, err)
+		err = nil
+	}
+
+	children.Lock()
+	delete(children.pids, cmd.Process.Pid)
+	children.Unlock()
+
+	return err
+}
+
+// SetSubreaper makes the current process a child subreaper.
+// Orphaned descendants, like helpers forked by the mounter, are reparented to it instead of the init process.
+func SetSubreaper() error {
+	return unix.Prctl(unix.PR_SET_CHILD_SUBREAPER, 1, 0, 0, 0)
+}
+
+// ReapZombies reaps zombie children which were not started with StartChild.
+func ReapZombies() {
+	children.Lock()
+	defer children.Unlock()
+
+	pids, err := zombieChildren()
+	if err != nil {
+		klog.Warningf("failed to list zombie processes: %v", err)
+		return
+	}
+
+	for _, pid := range pids {
+		if children.pids[pid] {
+			continue
+		}
+		var ws unix.WaitStatus
+		if _, err := unix.Wait4(pid, &ws, unix.WNOHANG, nil); err != nil {
+			klog.Warningf("failed to reap process %d: %v", pid, err)
+			continue
+		}
+		klog.V(4).Infof("reaped orphaned process %d (exit status %d)", pid, ws.ExitStatus())
+	}
+}
+
+// zombieChildren lists the zombie children of the current process from /proc.
+func zombieChildren() ([]int, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+
+	self := os.Getpid()
+	pids := []int{}
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		state, ppid, err := readProcStat(pid)
+		if err != nil {
+			// The process may have exited.
+			continue
+		}
+		if ppid == self && state == "Z" {
+			pids = append(pids, pid)
+		}
+	}
+
+	return pids, nil
+}
+
+// readProcStat returns the state and the parent pid in /proc/<pid>/stat.
+func readProcStat(pid int) (string, int, error) {
+	b, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return "", 0, err
+	}
+
+	// The command name may contain spaces and parentheses. Fields start after its last ')'.
+	stat := string(b)
+	i := strings.LastIndex(stat, ")")
+	if i < 0 {
+		return "", 0, fmt.Errorf("malformed stat of process %d", pid)
+	}
+	fields := strings.Fields(stat[i+1:])
+	if len(fields) < 2 {
+		return "", 0, fmt.Errorf("malformed stat of process %d", pid)
+	}
+	ppid, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return "", 0, fmt.Errorf("malformed stat of process %d: %w", pid, err)
+	}
+
+	return fields[0], ppid, nil
+}
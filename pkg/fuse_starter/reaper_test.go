@@ -0,0 +1,72 @@
+/*
+Copyright 2023 Preferred Networks, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fusestarter
+
+import (
+	"os/exec"
+	"testing"
+	"time"
+)
+
+// TestReapZombies is not parallel because reaping affects every child of the test process.
+func TestReapZombies(t *testing.T) {
+	if err := SetSubreaper(); err != nil {
+		t.Skipf("failed to become a child subreaper: %v", err)
+	}
+	// Reap the orphans of the previous tests, which are reparented to the test process once it became a subreaper.
+	ReapZombies()
+
+	// The shell exits immediately and the orphaned sleep is reparented to the test process.
+	if err := exec.Command("/bin/sh", "-c", "sleep 0.1 & exit 0").Run(); err != nil {
+		t.Fatalf("failed to run the command: %v", err)
+	}
+
+	// The child started with StartChild must be left for WaitChild.
+	cmd := exec.Command("/bin/sh", "-c", "exit 3")
+	if err := StartChild(cmd); err != nil {
+		t.Fatalf("failed to start the command: %v", err)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		pids, err := zombieChildren()
+		if err != nil {
+			t.Fatalf("failed to list zombie processes: %v", err)
+		}
+		if len(pids) == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Got zombies %v, but expected 2 zombies", pids)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ReapZombies()
+
+	pids, err := zombieChildren()
+	if err != nil {
+		t.Fatalf("failed to list zombie processes: %v", err)
+	}
+	if len(pids) != 1 || pids[0] != cmd.Process.Pid {
+		t.Errorf("Got zombies %v, but expected only %d", pids, cmd.Process.Pid)
+	}
+
+	if code := ExitCode(WaitChild(cmd)); code != 3 {
+		t.Errorf("Got exit code %d, but expected 3", code)
+	}
+}
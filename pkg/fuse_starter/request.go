@@ -0,0 +1,282 @@
+/*
+Copyright 2023 Preferred Networks, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fusestarter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+
+	"k8s.io/klog/v2"
+)
+
+type RequestOp string
+
+// ErrRefused is wrapped by errors with the reason why the CSI driver refused a request.
+var ErrRefused = errors.New("CSI driver refused the request")
+
+const (
+	// RequestOpMount asks the CSI driver to mount the FUSE filesystem and send the FUSE fd.
+	RequestOpMount RequestOp = "mount"
+	// RequestOpUnmount asks the CSI driver to unmount the FUSE filesystem mounted by RequestOpMount.
+	RequestOpUnmount RequestOp = "unmount"
+	// RequestOpRemount asks the CSI driver to unmount the FUSE filesystem and mount it again with a new FUSE fd.
+	// It is replied like RequestOpMount.
+	RequestOpRemount RequestOp = "remount"
+	// RequestOpStatus asks the CSI driver for the MountStatus.
+	RequestOpStatus RequestOp = "status"
+	// RequestOpReport reports the readiness and the health of the FUSE daemon to the CSI driver.
+	RequestOpReport RequestOp = "report"
+	// RequestOpWatch keeps the connection open to receive Notifications from the CSI driver.
+	RequestOpWatch RequestOp = "watch"
+)
+
+const (
+	// RequestTimeout limits a request to the CSI driver after connecting to the socket.
+	// It is longer than the forced unmount of the CSI driver on RequestOpUnmount and RequestOpRemount.
+	RequestTimeout = time.Second * 10
+	// ReportTimeout limits RequestOpReport, which is sent while the status of the mounter changes.
+	ReportTimeout = time.Second
+)
+
+// MaxMountOptionValueLength limits the values of the "fsname=" and "subtype=" options.
+const MaxMountOptionValueLength = 255
+
+// subtypePattern is the characters allowed in the "subtype=" option, which becomes the filesystem type "fuse.<subtype>".
+var subtypePattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// Event is notified by the CSI driver on the connection of RequestOpWatch.
+type Event string
+
+const (
+	// EventTeardown is notified before the CSI driver unmounts the FUSE filesystem on NodeUnpublishVolume.
+	// kubelet unpublishes the volume after the containers of the Pod stopped,
+	// so only the clients still running then, like daemons outside of the Pod, receive it.
+	EventTeardown Event = "teardown"
+)
+
+// Request is sent by a client first on each connection to the fd passing socket.
+// The CSI driver treats a connection without a request as RequestOpMount for clients before requests were introduced.
+type Request struct {
+	Op RequestOp `json:"op"`
+	// Token is the one in MountConfig received by RequestOpMount. It is required by RequestOpUnmount.
+	Token string `json:"token,omitempty"`
+	// Lazy detaches the mount like umount -l instead of forcing the unmount.
+	Lazy bool `json:"lazy,omitempty"`
+	// Options are the mount options requested by RequestOpMount, like "noatime" and "subtype=sshfs".
+	// The CSI driver refuses options which are not allowed.
+	Options []string `json:"options,omitempty"`
+	// Report is the state of the FUSE daemon reported by RequestOpReport.
+	Report *Report `json:"report,omitempty"`
+}
+
+// Report is the state of the FUSE daemon seen by the client.
+type Report struct {
+	Ready   bool   `json:"ready"`
+	Healthy bool   `json:"healthy"`
+	Message string `json:"message,omitempty"`
+}
+
+// MountStatus is the state of the FUSE filesystem seen by the CSI driver.
+type MountStatus struct {
+	Mounted    bool   `json:"mounted"`
+	VolumeName string `json:"volumeName,omitempty"`
+	MountPoint string `json:"mountPoint,omitempty"`
+	// Report is the last one reported by the client, if any.
+	Report *Report `json:"report,omitempty"`
+	// ReportedAt is when Report was received.
+	ReportedAt *time.Time `json:"reportedAt,omitempty"`
+}
+
+// Notification is sent by the CSI driver on the connection of RequestOpWatch.
+// The CSI driver does not wait for the client to handle it.
+type Notification struct {
+	Event Event `json:"event"`
+}
+
+// ValidateFsname checks the value of the "fsname=" option, which the CSI driver passes to mount(8) as the source.
+// A value like "--bind" or "-T<file>" would be taken as an option of mount(8), and a comma would split mount options.
+func ValidateFsname(v string) error {
+	if err := validateMountOptionValue(v); err != nil {
+		return err
+	}
+	if strings.IndexFunc(v, func(r rune) bool { return r == ',' || unicode.IsSpace(r) || unicode.IsControl(r) }) >= 0 {
+		return fmt.Errorf("must not contain commas, whitespaces or control characters")
+	}
+
+	return nil
+}
+
+// ValidateSubtype checks the value of the "subtype=" option, which the CSI driver passes to mount(8) as "-t fuse.<subtype>".
+func ValidateSubtype(v string) error {
+	if err := validateMountOptionValue(v); err != nil {
+		return err
+	}
+	if !subtypePattern.MatchString(v) {
+		return fmt.Errorf("must consist of alphanumerics, '.', '_' and '-'")
+	}
+
+	return nil
+}
+
+func validateMountOptionValue(v string) error {
+	if v == "" {
+		return fmt.Errorf("must not be empty")
+	}
+	if len(v) > MaxMountOptionValueLength {
+		return fmt.Errorf("must not be longer than %d bytes", MaxMountOptionValueLength)
+	}
+	if strings.HasPrefix(v, "-") {
+		return fmt.Errorf("must not start with '-'")
+	}
+
+	return nil
+}
+
+// Response is the reply of the CSI driver to requests other than a successful RequestOpMount,
+// which is replied with MountConfig and the FUSE fd.
+type Response struct {
+	// Error is the reason why the CSI driver refused the request, if not empty.
+	Error string `json:"error,omitempty"`
+	// Status is the reply to RequestOpStatus.
+	Status *MountStatus `json:"status,omitempty"`
+}
+
+func sendRequest(c net.Conn, req Request) error {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("failed to marshal the request: %w", err)
+	}
+	if _, err := c.Write(b); err != nil {
+		return fmt.Errorf("failed to send the %s request: %w", req.Op, err)
+	}
+
+	return nil
+}
+
+// request sends req to the CSI driver via the socket sp and receives the response within timeout.
+func request(sp string, timeout time.Duration, req Request) (*Response, error) {
+	klog.V(4).Infof("connecting to socket %q", sp)
+	// The socket exists as long as the filesystem is mounted, so it is not waited for.
+	c, err := Dial(sp, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	if err := c.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+
+	if err := sendRequest(c, req); err != nil {
+		return nil, err
+	}
+
+	return receiveResponse(c, sp)
+}
+
+func receiveResponse(c net.Conn, sp string) (*Response, error) {
+	resp := Response{}
+	if err := json.NewDecoder(c).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("failed to receive the response from the socket %q: %w", sp, err)
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("%w: %s", ErrRefused, resp.Error)
+	}
+
+	return &resp, nil
+}
+
+// RequestUnmount asks the CSI driver to unmount the FUSE filesystem mounted via the socket sp.
+// token authenticates the caller as the owner of the mount.
+func RequestUnmount(sp string, token string, lazy bool) error {
+	_, err := request(sp, RequestTimeout, Request{Op: RequestOpUnmount, Token: token, Lazy: lazy})
+	return err
+}
+
+// RequestRemount asks the CSI driver to unmount the FUSE filesystem and mount it again with options.
+// It returns the new FUSE fd and MountConfig, which has a new token.
+func RequestRemount(sp string, token string, options []string) (*MountConfig, error) {
+	return requestMountConfig(sp, 0, RequestTimeout, Request{Op: RequestOpRemount, Token: token, Options: options})
+}
+
+// RequestStatus asks the CSI driver for the state of the FUSE filesystem.
+func RequestStatus(sp string, token string) (*MountStatus, error) {
+	resp, err := request(sp, RequestTimeout, Request{Op: RequestOpStatus, Token: token})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Status == nil {
+		return nil, fmt.Errorf("CSI driver replied without the status")
+	}
+
+	return resp.Status, nil
+}
+
+// ReportStatus reports the readiness and the health of the FUSE daemon to the CSI driver.
+func ReportStatus(sp string, token string, report Report) error {
+	_, err := request(sp, ReportTimeout, Request{Op: RequestOpReport, Token: token, Report: &report})
+	return err
+}
+
+// WatchNotifications receives Notifications from the CSI driver until the connection is closed by the CSI driver or stopCh.
+// handle is called for each notification.
+// It returns nil when the CSI driver closed the socket, like after NodeUnpublishVolume.
+func WatchNotifications(sp string, token string, handle func(Notification), stopCh <-chan struct{}) error {
+	c, err := Dial(sp, 0)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-stopCh:
+			c.Close()
+		case <-done:
+		}
+	}()
+
+	if err := sendRequest(c, Request{Op: RequestOpWatch, Token: token}); err != nil {
+		return err
+	}
+	dec := json.NewDecoder(c)
+	resp := Response{}
+	if err := dec.Decode(&resp); err != nil {
+		return fmt.Errorf("failed to receive the response from the socket %q: %w", sp, err)
+	}
+	if resp.Error != "" {
+		return fmt.Errorf("%w: %s", ErrRefused, resp.Error)
+	}
+
+	for {
+		n := Notification{}
+		if err := dec.Decode(&n); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return fmt.Errorf("failed to receive the notification from the socket %q: %w", sp, err)
+		}
+		handle(n)
+	}
+}
@@ -0,0 +1,332 @@
+/*
+Copyright 2023 Preferred Networks, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fusestarter
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequestUnmount(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name          string
+		lazy          bool
+		response      Response
+		expectedError string
+	}{
+		{
+			name:     "should succeed when the driver unmounted",
+			lazy:     true,
+			response: Response{},
+		},
+		{
+			name:          "should return error with the reason when the driver refused",
+			response:      Response{Error: "token does not match the one of the mount"},
+			expectedError: "CSI driver refused the request: token does not match the one of the mount",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+
+		sp := filepath.Join(t.TempDir(), "test.sock")
+		l, err := net.Listen("unix", sp)
+		if err != nil {
+			t.Fatalf("failed to listen on %q: %v", sp, err)
+		}
+		reqCh := make(chan Request, 1)
+		go func(resp Response) {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+			req := Request{}
+			if err := json.NewDecoder(c).Decode(&req); err != nil {
+				t.Errorf("failed to decode the request: %v", err)
+				return
+			}
+			reqCh <- req
+			b, _ := json.Marshal(resp)
+			c.Write(b)
+		}(tc.response)
+
+		err = RequestUnmount(sp, "token", tc.lazy)
+		l.Close()
+		if tc.expectedError != "" {
+			if err == nil {
+				t.Errorf("Expected error but got none")
+			} else if !strings.Contains(err.Error(), tc.expectedError) {
+				t.Errorf("Got error %q, but expected to contain %q", err, tc.expectedError)
+			}
+		} else if err != nil {
+			t.Errorf("Did not expect error but got: %v", err)
+		}
+
+		expected := Request{Op: RequestOpUnmount, Token: "token", Lazy: tc.lazy}
+		if req := <-reqCh; !reflect.DeepEqual(req, expected) {
+			t.Errorf("Got request %+v, but expected %+v", req, expected)
+		}
+	}
+}
+
+func TestPrepareMountConfigRefusedWithReason(t *testing.T) {
+	t.Parallel()
+
+	sp := filepath.Join(t.TempDir(), "test.sock")
+	l, err := net.Listen("unix", sp)
+	if err != nil {
+		t.Fatalf("failed to listen on %q: %v", sp, err)
+	}
+	defer l.Close()
+	reqCh := make(chan Request, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		req := Request{}
+		if err := json.NewDecoder(c).Decode(&req); err != nil {
+			t.Errorf("failed to decode the request: %v", err)
+			return
+		}
+		reqCh <- req
+		// Reply with the reason without the fd.
+		b, _ := json.Marshal(Response{Error: `option "suid" is not allowed`})
+		c.Write(b)
+	}()
+
+	_, err = PrepareMountConfig(sp, time.Second, []string{"suid"})
+	if err == nil {
+		t.Fatalf("Expected error but got none")
+	}
+	if !errors.Is(err, ErrRefused) || !strings.Contains(err.Error(), `option "suid" is not allowed`) {
+		t.Errorf("Got error %q, but expected to be refused with the reason", err)
+	}
+
+	expected := Request{Op: RequestOpMount, Options: []string{"suid"}}
+	if req := <-reqCh; !reflect.DeepEqual(req, expected) {
+		t.Errorf("Got request %+v, but expected %+v", req, expected)
+	}
+}
+
+func TestRequestStatus(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name           string
+		response       Response
+		expectedStatus *MountStatus
+		expectedError  string
+	}{
+		{
+			name:           "should return the status",
+			response:       Response{Status: &MountStatus{Mounted: true, VolumeName: "volume", Report: &Report{Ready: true}}},
+			expectedStatus: &MountStatus{Mounted: true, VolumeName: "volume", Report: &Report{Ready: true}},
+		},
+		{
+			name:          "should return error with the reason when the driver refused",
+			response:      Response{Error: "token does not match the one of the mount"},
+			expectedError: "CSI driver refused the request: token does not match the one of the mount",
+		},
+		{
+			name:          "should return error without the status",
+			response:      Response{},
+			expectedError: "CSI driver replied without the status",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+
+		sp := filepath.Join(t.TempDir(), "test.sock")
+		l, err := net.Listen("unix", sp)
+		if err != nil {
+			t.Fatalf("failed to listen on %q: %v", sp, err)
+		}
+		go func(resp Response) {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+			req := Request{}
+			if err := json.NewDecoder(c).Decode(&req); err != nil || req.Op != RequestOpStatus || req.Token != "token" {
+				t.Errorf("Got request %+v, but expected the status request with the token", req)
+				return
+			}
+			b, _ := json.Marshal(resp)
+			c.Write(b)
+		}(tc.response)
+
+		status, err := RequestStatus(sp, "token")
+		l.Close()
+		if tc.expectedError != "" {
+			if err == nil {
+				t.Errorf("Expected error but got none")
+			} else if !strings.Contains(err.Error(), tc.expectedError) {
+				t.Errorf("Got error %q, but expected to contain %q", err, tc.expectedError)
+			}
+
+			continue
+		}
+		if err != nil {
+			t.Errorf("Did not expect error but got: %v", err)
+			continue
+		}
+		if !reflect.DeepEqual(status, tc.expectedStatus) {
+			t.Errorf("Got status %+v, but expected %+v", status, tc.expectedStatus)
+		}
+	}
+}
+
+func TestWatchNotifications(t *testing.T) {
+	t.Parallel()
+
+	sp := filepath.Join(t.TempDir(), "test.sock")
+	l, err := net.Listen("unix", sp)
+	if err != nil {
+		t.Fatalf("failed to listen on %q: %v", sp, err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		dec := json.NewDecoder(c)
+		req := Request{}
+		if err := dec.Decode(&req); err != nil || req.Op != RequestOpWatch {
+			t.Errorf("Got request %+v, but expected the watch request", req)
+			return
+		}
+		b, _ := json.Marshal(Response{})
+		c.Write(b)
+		b, _ = json.Marshal(Notification{Event: EventTeardown})
+		c.Write(b)
+		// Closing the connection ends the watch.
+	}()
+
+	events := []Event{}
+	err = WatchNotifications(sp, "token", func(n Notification) {
+		events = append(events, n.Event)
+	}, make(chan struct{}))
+	if err != nil {
+		t.Errorf("Did not expect error but got: %v", err)
+	}
+	if !reflect.DeepEqual(events, []Event{EventTeardown}) {
+		t.Errorf("Got events %v, but expected %v", events, []Event{EventTeardown})
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name string
+		send func(sp string, timeout time.Duration) error
+	}{
+		{
+			name: "should time out a request without the response",
+			send: func(sp string, timeout time.Duration) error {
+				_, err := request(sp, timeout, Request{Op: RequestOpStatus, Token: "token"})
+				return err
+			},
+		},
+		{
+			name: "should time out a remount request without the fd",
+			send: func(sp string, timeout time.Duration) error {
+				_, err := requestMountConfig(sp, 0, timeout, Request{Op: RequestOpRemount, Token: "token"})
+				return err
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+
+		sp := filepath.Join(t.TempDir(), "test.sock")
+		l, err := net.Listen("unix", sp)
+		if err != nil {
+			t.Fatalf("failed to listen on %q: %v", sp, err)
+		}
+		// The server accepts the connection but never replies.
+		go func() {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			//nolint:errcheck
+			io.Copy(io.Discard, c)
+			c.Close()
+		}()
+
+		err = tc.send(sp, 100*time.Millisecond)
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("Got error %v, but expected %v", err, os.ErrDeadlineExceeded)
+		}
+		l.Close()
+	}
+}
+
+func TestValidateMountOptionValues(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name          string
+		validate      func(string) error
+		value         string
+		expectedError bool
+	}{
+		{name: "should accept fsname of sshfs", validate: ValidateFsname, value: "user@host:/dir"},
+		{name: "should reject fsname starting with '-'", validate: ValidateFsname, value: "-T/fstab", expectedError: true},
+		{name: "should reject fsname with a comma", validate: ValidateFsname, value: "a,b", expectedError: true},
+		{name: "should reject fsname with a whitespace", validate: ValidateFsname, value: "a b", expectedError: true},
+		{name: "should reject fsname with a control character", validate: ValidateFsname, value: "a\nb", expectedError: true},
+		{name: "should reject too long fsname", validate: ValidateFsname, value: strings.Repeat("a", MaxMountOptionValueLength+1), expectedError: true},
+		{name: "should reject empty fsname", validate: ValidateFsname, value: "", expectedError: true},
+		{name: "should accept subtype", validate: ValidateSubtype, value: "mountpoint-s3.v1_0"},
+		{name: "should reject subtype starting with '-'", validate: ValidateSubtype, value: "-sshfs", expectedError: true},
+		{name: "should reject subtype with '/'", validate: ValidateSubtype, value: "a/b", expectedError: true},
+		{name: "should reject subtype with a comma", validate: ValidateSubtype, value: "a,b", expectedError: true},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+
+		err := tc.validate(tc.value)
+		if tc.expectedError {
+			if err == nil {
+				t.Errorf("Expected error but got none")
+			}
+		} else if err != nil {
+			t.Errorf("Did not expect error but got: %v", err)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+/*
+Copyright 2023 Preferred Networks, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fusestarter
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// SandboxExecCommand is the subcommand of fuse-starter which sandboxes itself and executes the mounter.
+	SandboxExecCommand = "sandbox-exec"
+
+	// envSandboxConfig passes SandboxConfig in JSON to the sandbox-exec subcommand.
+	envSandboxConfig = "FUSE_STARTER_SANDBOX_CONFIG"
+	// selfExePath re-executes the running fuse-starter binary.
+	selfExePath = "/proc/self/exe"
+
+	landlockAccessFsRead = unix.LANDLOCK_ACCESS_FS_EXECUTE | unix.LANDLOCK_ACCESS_FS_READ_FILE | unix.LANDLOCK_ACCESS_FS_READ_DIR
+	// landlockAccessFile is the access rights applicable to regular files, not directories.
+	landlockAccessFile = unix.LANDLOCK_ACCESS_FS_EXECUTE | unix.LANDLOCK_ACCESS_FS_WRITE_FILE | unix.LANDLOCK_ACCESS_FS_READ_FILE | unix.LANDLOCK_ACCESS_FS_TRUNCATE
+)
+
+// landlockAccessFsByABI is the filesystem access rights handled by each Landlock ABI version.
+var landlockAccessFsByABI = []uint64{
+	1: 0x1fff,
+	2: 0x3fff, // LANDLOCK_ACCESS_FS_REFER
+	3: 0x7fff, // LANDLOCK_ACCESS_FS_TRUNCATE
+}
+
+// SandboxConfig hardens the mounter process.
+// Landlock and seccomp imply NoNewPrivs, since they cannot be applied by an unprivileged process without it.
+type SandboxConfig struct {
+	UID *int `json:"uid,omitempty"`
+	GID *int `json:"gid,omitempty"`
+	// SupplementaryGroups replaces the supplementary groups. They are dropped if UID or GID is specified.
+	SupplementaryGroups []int `json:"supplementaryGroups,omitempty"`
+	NoNewPrivs          bool  `json:"noNewPrivs,omitempty"`
+	// RlimitNofile and RlimitNproc set both the soft and hard limits.
+	RlimitNofile *uint64 `json:"rlimitNofile,omitempty"`
+	RlimitNproc  *uint64 `json:"rlimitNproc,omitempty"`
+	// LandlockReadOnlyPaths and LandlockReadWritePaths are the only paths the mounter can access if any of them is specified.
+	// The mounter binary and its libraries must be included.
+	LandlockReadOnlyPaths  []string `json:"landlockReadOnlyPaths,omitempty"`
+	LandlockReadWritePaths []string `json:"landlockReadWritePaths,omitempty"`
+	// SeccompProfile is the path to a seccomp filter compiled to BPF, e.g. with seccomp_export_bpf(3) of libseccomp.
+	SeccompProfile string `json:"seccompProfile,omitempty"`
+}
+
+// Validate checks the values which can be checked before starting the mounter.
+func (c *SandboxConfig) Validate() error {
+	if c.UID != nil && *c.UID < 0 {
+		return fmt.Errorf("uid %d is negative", *c.UID)
+	}
+	if c.GID != nil && *c.GID < 0 {
+		return fmt.Errorf("gid %d is negative", *c.GID)
+	}
+	for _, g := range c.SupplementaryGroups {
+		if g < 0 {
+			return fmt.Errorf("supplementary group %d is negative", g)
+		}
+	}
+
+	return nil
+}
+
+func (c *SandboxConfig) landlockEnabled() bool {
+	return len(c.LandlockReadOnlyPaths) > 0 || len(c.LandlockReadWritePaths) > 0
+}
+
+// sandboxCommand returns the path and args to execute the mounter via the sandbox-exec subcommand,
+// and the environment variable passing the config.
+func sandboxCommand(config *SandboxConfig, mounterPath string, args []string) (string, []string, string, error) {
+	b, err := json.Marshal(config)
+	if err != nil {
+		return "", nil, "", fmt.Errorf("failed to marshal sandbox config: %w", err)
+	}
+
+	sandboxArgs := append([]string{os.Args[0], SandboxExecCommand, "--", mounterPath}, args...)
+
+	return selfExePath, sandboxArgs, fmt.Sprintf("%s=%s", envSandboxConfig, b), nil
+}
+
+// SandboxExec implements the sandbox-exec subcommand, which is executed by fuse-starter in place of the mounter.
+// args are "--", the mounter path and the mounter args. It sandboxes the process and executes the mounter.
+// It returns only on failure.
+func SandboxExec(args []string) error {
+	if len(args) < 2 || args[0] != "--" {
+		return fmt.Errorf("usage: %s -- <mounter> [args...]", SandboxExecCommand)
+	}
+	mounterPath := args[1]
+
+	config := SandboxConfig{}
+	if err := json.Unmarshal([]byte(os.Getenv(envSandboxConfig)), &config); err != nil {
+		return fmt.Errorf("failed to unmarshal %s: %w", envSandboxConfig, err)
+	}
+	env := []string{}
+	for _, e := range os.Environ() {
+		if !strings.HasPrefix(e, envSandboxConfig+"=") {
+			env = append(env, e)
+		}
+	}
+
+	// Landlock and seccomp apply only to the calling thread, which must be the one calling execve(2).
+	runtime.LockOSThread()
+
+	// Read the profile before Landlock restricts filesystem access.
+	var filter []unix.SockFilter
+	if config.SeccompProfile != "" {
+		var err error
+		if filter, err = readSeccompProfile(config.SeccompProfile); err != nil {
+			return err
+		}
+	}
+
+	if err := setRlimit(unix.RLIMIT_NOFILE, "RLIMIT_NOFILE", config.RlimitNofile); err != nil {
+		return err
+	}
+	if err := setRlimit(unix.RLIMIT_NPROC, "RLIMIT_NPROC", config.RlimitNproc); err != nil {
+		return err
+	}
+
+	// syscall.Setuid and others change the credentials of all threads.
+	if config.UID != nil || config.GID != nil || config.SupplementaryGroups != nil {
+		if err := syscall.Setgroups(config.SupplementaryGroups); err != nil {
+			return fmt.Errorf("failed to set supplementary groups %v: %w", config.SupplementaryGroups, err)
+		}
+	}
+	if config.GID != nil {
+		if err := syscall.Setgid(*config.GID); err != nil {
+			return fmt.Errorf("failed to set gid %d: %w", *config.GID, err)
+		}
+	}
+	if config.UID != nil {
+		if err := syscall.Setuid(*config.UID); err != nil {
+			return fmt.Errorf("failed to set uid %d: %w", *config.UID, err)
+		}
+	}
+
+	if config.NoNewPrivs || config.landlockEnabled() || filter != nil {
+		if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+			return fmt.Errorf("failed to set no_new_privs: %w", err)
+		}
+	}
+
+	if config.landlockEnabled() {
+		if err := applyLandlock(config.LandlockReadOnlyPaths, config.LandlockReadWritePaths); err != nil {
+			return err
+		}
+	}
+
+	// seccomp is applied last not to filter the syscalls above.
+	if filter != nil {
+		prog := unix.SockFprog{
+			Len:    uint16(len(filter)),
+			Filter: &filter[0],
+		}
+		if err := unix.Prctl(unix.PR_SET_SECCOMP, unix.SECCOMP_MODE_FILTER, uintptr(unsafe.Pointer(&prog)), 0, 0); err != nil {
+			return fmt.Errorf("failed to apply seccomp profile %q: %w", config.SeccompProfile, err)
+		}
+	}
+
+	//nolint:gosec
+	if err := syscall.Exec(mounterPath, args[1:], env); err != nil {
+		return fmt.Errorf("failed to execute %q: %w", mounterPath, err)
+	}
+
+	return nil
+}
+
+func setRlimit(resource int, name string, limit *uint64) error {
+	if limit == nil {
+		return nil
+	}
+	if err := unix.Setrlimit(resource, &unix.Rlimit{Cur: *limit, Max: *limit}); err != nil {
+		return fmt.Errorf("failed to set %s to %d: %w", name, *limit, err)
+	}
+
+	return nil
+}
+
+// readSeccompProfile reads an array of struct sock_filter in the native byte order.
+func readSeccompProfile(path string) ([]unix.SockFilter, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read seccomp profile %q: %w", path, err)
+	}
+	const size = int(unsafe.Sizeof(unix.SockFilter{}))
+	if len(b) == 0 || len(b)%size != 0 || len(b)/size > 0xffff {
+		return nil, fmt.Errorf("seccomp profile %q is not a BPF program: %d bytes", path, len(b))
+	}
+
+	filter := make([]unix.SockFilter, len(b)/size)
+	copy(unsafe.Slice((*byte)(unsafe.Pointer(&filter[0])), len(b)), b)
+
+	return filter, nil
+}
+
+// landlockABI returns the Landlock ABI version supported by the kernel.
+func landlockABI() (int, error) {
+	abi, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, 0, 0, unix.LANDLOCK_CREATE_RULESET_VERSION)
+	if errno != 0 {
+		return 0, fmt.Errorf("the kernel does not support Landlock: %w", errno)
+	}
+
+	return int(abi), nil
+}
+
+// applyLandlock restricts filesystem access of the calling thread to the paths.
+func applyLandlock(readOnlyPaths, readWritePaths []string) error {
+	abi, err := landlockABI()
+	if err != nil {
+		return err
+	}
+	if abi >= len(landlockAccessFsByABI) {
+		abi = len(landlockAccessFsByABI) - 1
+	}
+	handled := landlockAccessFsByABI[abi]
+
+	attr := unix.LandlockRulesetAttr{Access_fs: handled}
+	fd, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return fmt.Errorf("failed to create Landlock ruleset: %w", errno)
+	}
+	rulesetFd := int(fd)
+	defer unix.Close(rulesetFd)
+
+	for _, p := range readOnlyPaths {
+		if err := addLandlockRule(rulesetFd, p, landlockAccessFsRead&handled); err != nil {
+			return err
+		}
+	}
+	for _, p := range readWritePaths {
+		if err := addLandlockRule(rulesetFd, p, handled); err != nil {
+			return err
+		}
+	}
+
+	if _, _, errno := unix.Syscall(unix.SYS_LANDLOCK_RESTRICT_SELF, uintptr(rulesetFd), 0, 0); errno != 0 {
+		return fmt.Errorf("failed to apply Landlock ruleset: %w", errno)
+	}
+
+	return nil
+}
+
+func addLandlockRule(rulesetFd int, path string, access uint64) error {
+	fd, err := unix.Open(path, unix.O_PATH|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open %q for Landlock rule: %w", path, err)
+	}
+	defer unix.Close(fd)
+
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		return fmt.Errorf("failed to stat %q for Landlock rule: %w", path, err)
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFDIR {
+		access &= landlockAccessFile
+	}
+
+	attr := unix.LandlockPathBeneathAttr{
+		Allowed_access: access,
+		Parent_fd:      int32(fd),
+	}
+	if _, _, errno := unix.Syscall6(unix.SYS_LANDLOCK_ADD_RULE, uintptr(rulesetFd), unix.LANDLOCK_RULE_PATH_BENEATH, uintptr(unsafe.Pointer(&attr)), 0, 0, 0); errno != 0 {
+		return fmt.Errorf("failed to add Landlock rule for %q: %w", path, errno)
+	}
+
+	return nil
+}
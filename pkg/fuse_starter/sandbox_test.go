@@ -0,0 +1,146 @@
+/*
+Copyright 2023 Preferred Networks, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fusestarter
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// TestMain runs the sandbox-exec subcommand when the test binary is executed by FuseStarter with Sandbox.
+func TestMain(m *testing.M) {
+	if len(os.Args) > 1 && os.Args[1] == SandboxExecCommand {
+		err := fmt.Errorf("%w: %w", ErrStartMounter, SandboxExec(os.Args[2:]))
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(ExitCode(err))
+	}
+
+	os.Exit(m.Run())
+}
+
+// writeSeccompProfile writes a BPF program denying uname(2) with EPERM.
+func writeSeccompProfile(t *testing.T) string {
+	t.Helper()
+
+	filter := []unix.SockFilter{
+		// Load the syscall number in struct seccomp_data.
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: 0},
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: 0, Jf: 1, K: unix.SYS_UNAME},
+		{Code: unix.BPF_RET | unix.BPF_K, K: unix.SECCOMP_RET_ERRNO | uint32(unix.EPERM)},
+		{Code: unix.BPF_RET | unix.BPF_K, K: unix.SECCOMP_RET_ALLOW},
+	}
+	b := unsafe.Slice((*byte)(unsafe.Pointer(&filter[0])), len(filter)*int(unsafe.Sizeof(filter[0])))
+
+	path := filepath.Join(t.TempDir(), "seccomp.bpf")
+	if err := os.WriteFile(path, b, 0o644); err != nil {
+		t.Fatalf("failed to write seccomp profile: %v", err)
+	}
+
+	return path
+}
+
+func TestSandbox(t *testing.T) {
+	t.Parallel()
+
+	if os.Getuid() != 0 {
+		t.Skip("changing uid requires root")
+	}
+
+	nobody := 65534
+	nofile := uint64(64)
+	secretDir := t.TempDir()
+	secret := filepath.Join(secretDir, "secret")
+	if err := os.WriteFile(secret, []byte("secret"), 0o644); err != nil {
+		t.Fatalf("failed to write %q: %v", secret, err)
+	}
+	systemPaths := []string{"/bin", "/usr", "/lib", "/etc", "/proc", "/dev"}
+	if _, err := os.Stat("/lib64"); err == nil {
+		systemPaths = append(systemPaths, "/lib64")
+	}
+
+	testCases := []struct {
+		name     string
+		config   SandboxConfig
+		landlock bool
+		script   string
+	}{
+		{
+			name:   "should run the mounter with the uid, gid and groups",
+			config: SandboxConfig{UID: &nobody, GID: &nobody, SupplementaryGroups: []int{nobody}},
+			script: `[ "$(id -u)" = 65534 ] && [ "$(id -g)" = 65534 ] && [ "$(id -G)" = 65534 ] && [ -e /dev/fd/3 ]`,
+		},
+		{
+			name:   "should set no_new_privs and rlimits",
+			config: SandboxConfig{NoNewPrivs: true, RlimitNofile: &nofile},
+			script: `grep -q 'NoNewPrivs:.*1' /proc/self/status && [ "$(ulimit -n)" = 64 ] && [ -z "$` + envSandboxConfig + `" ]`,
+		},
+		{
+			name:     "should limit filesystem access with Landlock",
+			config:   SandboxConfig{LandlockReadOnlyPaths: systemPaths},
+			landlock: true,
+			script:   fmt.Sprintf("head -c 0 /etc/passwd && ! head -c 0 %s", secret),
+		},
+		{
+			name:   "should apply the seccomp profile",
+			config: SandboxConfig{SeccompProfile: writeSeccompProfile(t)},
+			script: "! uname && grep -q 'Seccomp:.*2' /proc/self/status",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		if tc.landlock {
+			if _, err := landlockABI(); err != nil {
+				t.Logf("skipping: %v", err)
+				continue
+			}
+		}
+
+		mc, _ := newTestMountConfig(t)
+		m := New("/bin/sh", []string{"-c", tc.script})
+		m.Sandbox = &tc.config
+		m.LogCapture = NewLogCapture("test-volume", LogFormatPrefix, 10)
+		cmd, err := m.Mount(mc)
+		if err != nil {
+			t.Fatalf("Did not expect error but got: %v", err)
+		}
+		if err := cmd.Run(); err != nil {
+			m.LogCapture.Flush()
+			t.Errorf("mounter failed in the sandbox: %v: %v", err, m.LogCapture.Recent())
+		}
+	}
+}
+
+func TestSandboxExecFailure(t *testing.T) {
+	t.Parallel()
+
+	mc, _ := newTestMountConfig(t)
+	m := New("/nonexistent", nil)
+	m.Sandbox = &SandboxConfig{NoNewPrivs: true}
+	cmd, err := m.Mount(mc)
+	if err != nil {
+		t.Fatalf("Did not expect error but got: %v", err)
+	}
+	if code := ExitCode(cmd.Run()); code != ExitCodeNotFound {
+		t.Errorf("Got exit code %d, but expected %d", code, ExitCodeNotFound)
+	}
+}
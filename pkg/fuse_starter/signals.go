@@ -0,0 +1,71 @@
+/*
+Copyright 2023 Preferred Networks, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fusestarter
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"k8s.io/klog/v2"
+)
+
+// ForwardedSignals are forwarded to the mounters as is. Daemons often use them for log rotation and reload.
+var ForwardedSignals = []os.Signal{syscall.SIGINT, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2}
+
+// ForwardSignals forwards ForwardedSignals received by the current process to the mounters of volumes.
+// It returns a function to stop forwarding.
+func ForwardSignals(volumes []*Volume) func() {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, ForwardedSignals...)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for sig := range sigCh {
+			klog.Infof("forwarding %v signal to the mounter processes", sig)
+			for _, v := range volumes {
+				v.Signal(sig)
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(sigCh)
+		close(sigCh)
+		<-done
+	}
+}
+
+// StartReaper reaps zombies on SIGCHLD, e.g. orphaned processes reparented to the current process
+// running as PID 1 or a child subreaper. It returns a function to stop reaping.
+func StartReaper() func() {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGCHLD)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range sigCh {
+			ReapZombies()
+		}
+	}()
+
+	return func() {
+		signal.Stop(sigCh)
+		close(sigCh)
+		<-done
+	}
+}
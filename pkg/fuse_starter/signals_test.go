@@ -0,0 +1,115 @@
+/*
+Copyright 2023 Preferred Networks, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fusestarter
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestForwardSignals is not parallel because the signal is sent to the test process.
+func TestForwardSignals(t *testing.T) {
+	dir := t.TempDir()
+	marker := filepath.Join(dir, "marker")
+	config := MounterConfig{
+		Name:                "signaled",
+		FdPassingSocketPath: filepath.Join(dir, "signaled.sock"),
+		MounterPath:         "/bin/sh",
+		// The mounter exits successfully only on SIGUSR1.
+		Args: []string{"-c", `trap 'touch "$MARKER"; exit 0' USR1; while :; do sleep 0.05; done`},
+		Env:  map[string]string{"MARKER": marker},
+	}
+	serveFd(t, config.FdPassingSocketPath, MountConfig{VolumeName: config.Name})
+	v := NewVolume(config, SupervisorConfig{}, 0, false)
+
+	stop := ForwardSignals([]*Volume{v})
+	defer stop()
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- v.Run() }()
+	for i := 0; v.Status().State != SupervisorStateRunning; i++ {
+		if i > 100 {
+			t.Fatalf("mounter did not start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Give the shell time to install the trap.
+	time.Sleep(100 * time.Millisecond)
+
+	if err := syscall.Kill(os.Getpid(), syscall.SIGUSR1); err != nil {
+		t.Fatalf("failed to send the signal: %v", err)
+	}
+
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Errorf("Did not expect error but got: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		v.Stop()
+		t.Fatalf("mounter did not receive the forwarded signal")
+	}
+	if _, err := os.Stat(marker); err != nil {
+		t.Errorf("Expected the mounter to handle the signal: %v", err)
+	}
+}
+
+// TestStartReaper is not parallel because reaping affects every child of the test process.
+func TestStartReaper(t *testing.T) {
+	if err := SetSubreaper(); err != nil {
+		t.Skipf("failed to become a child subreaper: %v", err)
+	}
+	stop := StartReaper()
+	defer stop()
+
+	// The shell exits immediately and the orphaned sleep is reparented to the test process.
+	out := bytes.Buffer{}
+	cmd := exec.Command("/bin/sh", "-c", "sleep 0.1 & echo $!")
+	cmd.Stdout = &out
+	if err := StartChild(cmd); err != nil {
+		t.Fatalf("failed to start the command: %v", err)
+	}
+	// The child started with StartChild is left for WaitChild.
+	if err := WaitChild(cmd); err != nil {
+		t.Fatalf("Did not expect error but got: %v", err)
+	}
+	orphan, err := strconv.Atoi(strings.TrimSpace(out.String()))
+	if err != nil {
+		t.Fatalf("failed to parse the pid of the orphan %q: %v", out.String(), err)
+	}
+
+	// The orphan is reaped on SIGCHLD when it exits.
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if _, err := os.Stat(fmt.Sprintf("/proc/%d", orphan)); os.IsNotExist(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			state, ppid, _ := readProcStat(orphan)
+			t.Fatalf("orphan %d is not reaped (state %q, parent %d)", orphan, state, ppid)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
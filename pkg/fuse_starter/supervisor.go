@@ -0,0 +1,361 @@
+/*
+Copyright 2023 Preferred Networks, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fusestarter
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"k8s.io/klog/v2"
+)
+
+type SupervisorState string
+
+const (
+	SupervisorStateStarting   SupervisorState = "Starting"
+	SupervisorStateRunning    SupervisorState = "Running"
+	SupervisorStateBackingOff SupervisorState = "BackingOff"
+	SupervisorStateExited     SupervisorState = "Exited"
+	SupervisorStateFailed     SupervisorState = "Failed"
+	SupervisorStateStopped    SupervisorState = "Stopped"
+)
+
+// SupervisorConfig configures how the mounter process is restarted.
+type SupervisorConfig struct {
+	// Enabled makes the supervisor keep the FUSE fd and restart the mounter after it crashed.
+	// Otherwise, the fd is closed once the mounter started and the mounter runs only once.
+	Enabled bool
+	// MaxRestarts is the number of restarts allowed. A negative value means unlimited.
+	MaxRestarts int
+	// InitialBackoff is the delay before the first restart. It doubles on every consecutive crash.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the delay. The delay is reset when the mounter ran longer than MaxBackoff.
+	MaxBackoff time.Duration
+	// StopGracePeriod is the time given to the mounter to exit after SIGTERM.
+	// After that, the process group of the mounter is killed with SIGKILL. Zero means no SIGKILL.
+	StopGracePeriod time.Duration
+	// SyncBeforeStop makes Stop sync filesystems before sending SIGTERM to the mounter.
+	SyncBeforeStop bool
+	// Watchdog kills the mounter whose FUSE filesystem hangs. It is run by Volume once the filesystem is ready.
+	Watchdog WatchdogConfig
+	// OnStatusChange is called with the latest status whenever it changes.
+	OnStatusChange func(SupervisorStatus)
+}
+
+// SupervisorStatus is the observable state of a supervised mounter.
+type SupervisorStatus struct {
+	VolumeName    string          `json:"volumeName"`
+	State         SupervisorState `json:"state"`
+	Restarts      int             `json:"restarts"`
+	Pid           int             `json:"pid,omitempty"`
+	LastStartTime time.Time       `json:"lastStartTime,omitempty"`
+	LastExitError string          `json:"lastExitError,omitempty"`
+}
+
+// Supervisor runs the mounter with the FUSE fd received from the CSI driver,
+// and restarts it with exponential backoff if it is enabled.
+type Supervisor struct {
+	starter *FuseStarter
+	mc      *MountConfig
+	config  SupervisorConfig
+
+	mu       sync.Mutex
+	cmd      *exec.Cmd
+	status   SupervisorStatus
+	stopped  bool
+	stopCh   chan struct{}
+	fdClosed bool
+}
+
+// NewSupervisor returns a Supervisor which owns mc.FileDescriptor.
+func NewSupervisor(starter *FuseStarter, mc *MountConfig, config SupervisorConfig) *Supervisor {
+	return &Supervisor{
+		starter: starter,
+		mc:      mc,
+		config:  config,
+		status: SupervisorStatus{
+			VolumeName: mc.VolumeName,
+			State:      SupervisorStateStarting,
+		},
+		stopCh: make(chan struct{}),
+	}
+}
+
+// Run starts the mounter and blocks until it exits without being restarted.
+// It returns the error of the last mounter process.
+func (s *Supervisor) Run() error {
+	defer s.closeFd()
+
+	backoff := s.config.InitialBackoff
+	for {
+		startTime := time.Now()
+		started, err := s.runOnce()
+		if s.isStopped() {
+			s.setState(SupervisorStateStopped, err)
+			return err
+		}
+		if err == nil {
+			klog.Infof("[%v] mounter exited normally.", s.mc.VolumeName)
+			s.setState(SupervisorStateExited, nil)
+			return nil
+		}
+		if !started {
+			s.setState(SupervisorStateFailed, err)
+			return err
+		}
+
+		if !s.config.Enabled || (s.config.MaxRestarts >= 0 && s.Status().Restarts >= s.config.MaxRestarts) {
+			s.setState(SupervisorStateFailed, err)
+			return err
+		}
+
+		if time.Since(startTime) > s.config.MaxBackoff {
+			backoff = s.config.InitialBackoff
+		}
+		klog.Errorf("[%v] mounter exited with error: %v, restarting in %v", s.mc.VolumeName, err, backoff)
+		s.setState(SupervisorStateBackingOff, err)
+		select {
+		case <-time.After(backoff):
+		case <-s.stopCh:
+			s.setState(SupervisorStateStopped, err)
+			return err
+		}
+		backoff *= 2
+		if backoff > s.config.MaxBackoff {
+			backoff = s.config.MaxBackoff
+		}
+
+		s.mu.Lock()
+		s.status.Restarts++
+		s.mu.Unlock()
+	}
+}
+
+// runOnce starts the mounter and waits for it to exit.
+// started is false if the mounter could not be started.
+func (s *Supervisor) runOnce() (started bool, err error) {
+	mc := *s.mc
+	if s.config.Enabled {
+		// Keep the original fd so that a restarted mounter can reattach to the FUSE session.
+		// The copy is close-on-exec like the original. ExtraFiles passes it to the mounter.
+		if mc.FileDescriptor, err = unix.FcntlInt(uintptr(s.mc.FileDescriptor), unix.F_DUPFD_CLOEXEC, 0); err != nil {
+			return false, fmt.Errorf("failed to duplicate the file descriptor: %w", err)
+		}
+	}
+
+	cmd, err := s.starter.Mount(&mc)
+	if err != nil {
+		return false, fmt.Errorf("%w: volume %q: %w", ErrStartMounter, mc.VolumeName, err)
+	}
+
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		s.closeExtraFiles(cmd)
+		return false, nil
+	}
+	if s.starter.LogCapture != nil {
+		s.starter.LogCapture.Reset()
+	}
+	err = StartChild(cmd)
+	// Since the mounter has taken over the file descriptor,
+	// closing the file descriptor to avoid other process forking it.
+	s.closeExtraFiles(cmd)
+	if err != nil {
+		s.mu.Unlock()
+		return false, fmt.Errorf("%w: %w", ErrStartMounter, err)
+	}
+	s.cmd = cmd
+	s.status.State = SupervisorStateRunning
+	s.status.Pid = cmd.Process.Pid
+	s.status.LastStartTime = time.Now()
+	s.mu.Unlock()
+	s.notify()
+
+	err = WaitChild(cmd)
+
+	s.mu.Lock()
+	s.cmd = nil
+	s.status.Pid = 0
+	s.mu.Unlock()
+
+	if s.starter.LogCapture != nil {
+		s.starter.LogCapture.Flush()
+		if lines := s.starter.LogCapture.Recent(); err != nil && len(lines) > 0 {
+			err = fmt.Errorf("%w\nrecent output of mounter:\n%s", err, strings.Join(lines, "\n"))
+		}
+	}
+
+	return true, err
+}
+
+// Stop sends SIGTERM to the running mounter and prevents further restarts.
+// If the mounter does not exit within StopGracePeriod, its process group is killed with SIGKILL.
+func (s *Supervisor) Stop() {
+	if s.config.SyncBeforeStop {
+		s.sync()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.stopped {
+		s.stopped = true
+		close(s.stopCh)
+	}
+
+	if s.cmd == nil {
+		return
+	}
+
+	if err := s.cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		klog.Warningf("[%v] failed to send SIGTERM signal to mounter process: %v", s.mc.VolumeName, err)
+	}
+
+	if s.config.StopGracePeriod > 0 {
+		cmd := s.cmd
+		time.AfterFunc(s.config.StopGracePeriod, func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+
+			if s.cmd != cmd {
+				// The mounter already exited.
+				return
+			}
+			klog.Warningf("[%v] mounter did not exit within %v, sending SIGKILL to its process group", s.mc.VolumeName, s.config.StopGracePeriod)
+			// The mounter is started with Setpgid, so its pid is the process group id.
+			if err := syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL); err != nil {
+				klog.Warningf("[%v] failed to send SIGKILL signal to mounter process group: %v", s.mc.VolumeName, err)
+			}
+		})
+	}
+}
+
+// Kill sends SIGKILL to the process group of the running mounter and prevents further restarts.
+// It is for a hung mounter, which cannot handle SIGTERM.
+func (s *Supervisor) Kill() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.stopped {
+		s.stopped = true
+		close(s.stopCh)
+	}
+
+	if s.cmd == nil {
+		return
+	}
+	// The mounter is started with Setpgid, so its pid is the process group id.
+	if err := syscall.Kill(-s.cmd.Process.Pid, syscall.SIGKILL); err != nil {
+		klog.Warningf("[%v] failed to send SIGKILL signal to mounter process group: %v", s.mc.VolumeName, err)
+	}
+}
+
+// sync flushes filesystems before the mounter is stopped.
+// A hung FUSE daemon blocks sync(2), so it gives up after StopGracePeriod.
+func (s *Supervisor) sync() {
+	klog.Infof("[%v] syncing filesystems before stopping mounter", s.mc.VolumeName)
+	done := make(chan struct{})
+	go func() {
+		syscall.Sync()
+		close(done)
+	}()
+
+	var timeout <-chan time.Time
+	if s.config.StopGracePeriod > 0 {
+		timeout = time.After(s.config.StopGracePeriod)
+	}
+	select {
+	case <-done:
+	case <-timeout:
+		klog.Warningf("[%v] sync did not finish within %v", s.mc.VolumeName, s.config.StopGracePeriod)
+	}
+}
+
+// Signal sends sig to the running mounter.
+func (s *Supervisor) Signal(sig os.Signal) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cmd == nil {
+		return
+	}
+	if err := s.cmd.Process.Signal(sig); err != nil {
+		klog.Warningf("[%v] failed to send %v signal to mounter process: %v", s.mc.VolumeName, sig, err)
+	}
+}
+
+// Status returns the current status of the supervised mounter.
+func (s *Supervisor) Status() SupervisorStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.status
+}
+
+func (s *Supervisor) isStopped() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.stopped
+}
+
+func (s *Supervisor) setState(state SupervisorState, exitErr error) {
+	s.mu.Lock()
+	s.status.State = state
+	if exitErr != nil {
+		s.status.LastExitError = exitErr.Error()
+	}
+	s.mu.Unlock()
+	s.notify()
+}
+
+func (s *Supervisor) notify() {
+	if s.config.OnStatusChange != nil {
+		s.config.OnStatusChange(s.Status())
+	}
+}
+
+// closeExtraFiles closes the files passed to the mounter in the current process.
+// When the supervisor is disabled, this closes the fd received from the CSI driver.
+func (s *Supervisor) closeExtraFiles(cmd *exec.Cmd) {
+	for _, f := range cmd.ExtraFiles {
+		if f != nil {
+			f.Close()
+		}
+	}
+	if !s.config.Enabled {
+		s.fdClosed = true
+	}
+}
+
+// closeFd closes the fd received from the CSI driver if it is still open.
+func (s *Supervisor) closeFd() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.fdClosed {
+		syscall.Close(s.mc.FileDescriptor)
+		s.fdClosed = true
+	}
+}
@@ -0,0 +1,198 @@
+/*
+Copyright 2023 Preferred Networks, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fusestarter
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// newTestMountConfig returns a MountConfig with the read end of a pipe standing in for the FUSE fd.
+// The write end fails with EPIPE once every copy of the read end is closed.
+func newTestMountConfig(t *testing.T) (*MountConfig, *os.File) {
+	t.Helper()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("failed to create a pipe: %v", err)
+	}
+	t.Cleanup(func() { w.Close() })
+
+	fd, err := syscall.Dup(int(r.Fd()))
+	if err != nil {
+		t.Fatalf("failed to duplicate the pipe: %v", err)
+	}
+	r.Close()
+
+	return &MountConfig{FileDescriptor: fd, VolumeName: "test-volume"}, w
+}
+
+func TestSupervisor(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name             string
+		script           string
+		config           SupervisorConfig
+		expectedError    bool
+		expectedState    SupervisorState
+		expectedRestarts int
+	}{
+		{
+			name:             "should not restart the mounter exited normally",
+			script:           "exit 0",
+			config:           SupervisorConfig{Enabled: true, MaxRestarts: 3},
+			expectedError:    false,
+			expectedState:    SupervisorStateExited,
+			expectedRestarts: 0,
+		},
+		{
+			name:             "should not restart the crashed mounter when the supervisor is disabled",
+			script:           "exit 1",
+			config:           SupervisorConfig{Enabled: false, MaxRestarts: 3},
+			expectedError:    true,
+			expectedState:    SupervisorStateFailed,
+			expectedRestarts: 0,
+		},
+		{
+			name:             "should restart the crashed mounter up to the limit",
+			script:           "exit 1",
+			config:           SupervisorConfig{Enabled: true, MaxRestarts: 3, InitialBackoff: time.Millisecond, MaxBackoff: 4 * time.Millisecond},
+			expectedError:    true,
+			expectedState:    SupervisorStateFailed,
+			expectedRestarts: 3,
+		},
+		{
+			name: "should pass the retained fd to the restarted mounter",
+			// fd 3 must be valid in every mounter process.
+			script:           "[ -e /dev/fd/3 ] || exit 0; exit 1",
+			config:           SupervisorConfig{Enabled: true, MaxRestarts: 2, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond},
+			expectedError:    true,
+			expectedState:    SupervisorStateFailed,
+			expectedRestarts: 2,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+
+		mc, w := newTestMountConfig(t)
+		s := NewSupervisor(New("/bin/sh", []string{"-c", tc.script}), mc, tc.config)
+		err := s.Run()
+		if tc.expectedError && err == nil {
+			t.Errorf("Expected error but got none")
+		}
+		if !tc.expectedError && err != nil {
+			t.Errorf("Did not expect error but got: %v", err)
+		}
+
+		status := s.Status()
+		if status.State != tc.expectedState {
+			t.Errorf("Got state %v, but expected %v", status.State, tc.expectedState)
+		}
+		if status.Restarts != tc.expectedRestarts {
+			t.Errorf("Got restarts %v, but expected %v", status.Restarts, tc.expectedRestarts)
+		}
+
+		if _, err := w.Write([]byte{0}); !errors.Is(err, syscall.EPIPE) {
+			t.Errorf("fd %d is not closed after the supervisor exited: %v", mc.FileDescriptor, err)
+		}
+	}
+}
+
+func TestSupervisorStop(t *testing.T) {
+	t.Parallel()
+
+	mc, _ := newTestMountConfig(t)
+	s := NewSupervisor(New("/bin/sh", []string{"-c", "exec sleep 60"}), mc, SupervisorConfig{Enabled: true, MaxRestarts: -1})
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- s.Run() }()
+
+	for s.Status().State != SupervisorStateRunning {
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.Stop()
+
+	select {
+	case <-errCh:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("supervisor did not stop")
+	}
+
+	if status := s.Status(); status.State != SupervisorStateStopped || status.Restarts != 0 {
+		t.Errorf("Got status %+v, but expected stopped without restarts", status)
+	}
+}
+
+func TestSupervisorStopEscalation(t *testing.T) {
+	t.Parallel()
+
+	// The mounter and its child ignore SIGTERM.
+	mc, _ := newTestMountConfig(t)
+	s := NewSupervisor(New("/bin/sh", []string{"-c", "trap '' TERM; sleep 60; exit 0"}), mc, SupervisorConfig{StopGracePeriod: 100 * time.Millisecond})
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- s.Run() }()
+
+	for s.Status().State != SupervisorStateRunning {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Give the shell time to install the trap.
+	time.Sleep(100 * time.Millisecond)
+	s.Stop()
+
+	select {
+	case err := <-errCh:
+		if code := ExitCode(err); code != 128+int(syscall.SIGKILL) {
+			t.Errorf("Got exit code %d, but expected %d: %v", code, 128+int(syscall.SIGKILL), err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("supervisor did not kill the mounter")
+	}
+}
+
+func TestSupervisorKill(t *testing.T) {
+	t.Parallel()
+
+	// The mounter ignores SIGTERM, and no grace period is set.
+	mc, _ := newTestMountConfig(t)
+	s := NewSupervisor(New("/bin/sh", []string{"-c", "trap '' TERM; sleep 60; exit 0"}), mc, SupervisorConfig{Enabled: true, MaxRestarts: -1})
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- s.Run() }()
+
+	for s.Status().State != SupervisorStateRunning {
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.Kill()
+
+	select {
+	case err := <-errCh:
+		if code := ExitCode(err); code != 128+int(syscall.SIGKILL) {
+			t.Errorf("Got exit code %d, but expected %d: %v", code, 128+int(syscall.SIGKILL), err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("supervisor did not kill the mounter")
+	}
+	if status := s.Status(); status.Restarts != 0 {
+		t.Errorf("Got %d restarts, but expected the killed mounter not to be restarted", status.Restarts)
+	}
+}
@@ -0,0 +1,56 @@
+/*
+Copyright 2023 Preferred Networks, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fusestarter
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// UserNamespaceConfig runs the mounter in a new user namespace.
+// The uid and gid of fuse-starter are mapped to UID and GID in the namespace, which default to root.
+// The mounter gains no privilege outside of the namespace, while the inherited FUSE fd keeps working.
+type UserNamespaceConfig struct {
+	UID int `json:"uid"`
+	GID int `json:"gid"`
+}
+
+// Validate checks the ids in the namespace.
+func (c *UserNamespaceConfig) Validate() error {
+	if c.UID < 0 {
+		return fmt.Errorf("uid %d is negative", c.UID)
+	}
+	if c.GID < 0 {
+		return fmt.Errorf("gid %d is negative", c.GID)
+	}
+
+	return nil
+}
+
+// apply makes the mounter started with attr run in a new user namespace.
+func (c *UserNamespaceConfig) apply(attr *syscall.SysProcAttr) {
+	attr.Cloneflags |= syscall.CLONE_NEWUSER
+	attr.UidMappings = []syscall.SysProcIDMap{
+		{ContainerID: c.UID, HostID: os.Getuid(), Size: 1},
+	}
+	attr.GidMappings = []syscall.SysProcIDMap{
+		{ContainerID: c.GID, HostID: os.Getgid(), Size: 1},
+	}
+	// An unprivileged process can write gid_map only after setgroups(2) is denied.
+	attr.GidMappingsEnableSetgroups = false
+}
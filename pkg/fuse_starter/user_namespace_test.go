@@ -0,0 +1,67 @@
+/*
+Copyright 2023 Preferred Networks, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fusestarter
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"testing"
+)
+
+func TestUserNamespace(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name   string
+		config UserNamespaceConfig
+		script string
+	}{
+		{
+			name:   "should run the mounter as root in the user namespace",
+			config: UserNamespaceConfig{},
+			script: fmt.Sprintf(`[ "$(id -u)" = 0 ] && [ "$(id -g)" = 0 ] && [ -e /dev/fd/3 ] && grep -q "^ *0 *%d *1$" /proc/self/uid_map`, os.Getuid()),
+		},
+		{
+			name:   "should run the mounter with the specified ids in the user namespace",
+			config: UserNamespaceConfig{UID: 1234, GID: 5678},
+			script: fmt.Sprintf(`[ "$(id -u)" = 1234 ] && [ "$(id -g)" = 5678 ] && grep -q "^ *5678 *%d *1$" /proc/self/gid_map`, os.Getgid()),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+
+		mc, _ := newTestMountConfig(t)
+		m := New("/bin/sh", []string{"-c", tc.script})
+		m.UserNamespace = &tc.config
+		cmd, err := m.Mount(mc)
+		if err != nil {
+			t.Fatalf("Did not expect error but got: %v", err)
+		}
+		err = cmd.Run()
+		var exitErr *exec.ExitError
+		if err != nil && !errors.As(err, &exitErr) {
+			// e.g. user namespaces are disabled by sysctl or seccomp.
+			t.Skipf("failed to create a user namespace: %v", err)
+		}
+		if err != nil {
+			t.Errorf("mounter failed in the user namespace: %v", err)
+		}
+	}
+}
@@ -0,0 +1,345 @@
+/*
+Copyright 2023 Preferred Networks, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fusestarter
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// SupervisorStateHandshaking is the state of a volume waiting for the fd from the CSI driver.
+const SupervisorStateHandshaking SupervisorState = "Handshaking"
+
+// Volume handles a FUSE volume: it receives the fd from the CSI driver,
+// runs the mounter under a Supervisor and probes the readiness.
+type Volume struct {
+	config             MounterConfig
+	supervisorConfig   SupervisorConfig
+	readyProbeInterval time.Duration
+	readinessEnabled   bool
+	readiness          *Readiness
+	// controlChannel enables the reports on the fd passing socket after the handshake.
+	controlChannel bool
+
+	mu          sync.Mutex
+	supervisor  *Supervisor
+	stopped     bool
+	err         error
+	abortErr    error
+	done        chan struct{}
+	probeStopCh chan struct{}
+}
+
+// NewVolume returns a Volume. supervisorConfig.OnStatusChange is called on every status change of the volume.
+// Readiness is probed only if readinessEnabled is true, the config has a ready file or postReady hooks, or the watchdog is enabled.
+func NewVolume(config MounterConfig, supervisorConfig SupervisorConfig, readyProbeInterval time.Duration, readinessEnabled bool) *Volume {
+	if config.Supervise != nil {
+		supervisorConfig.Enabled = *config.Supervise
+	}
+	if config.MaxRestarts != nil {
+		supervisorConfig.MaxRestarts = *config.MaxRestarts
+	}
+
+	// postReady hooks and the watchdog wait for the readiness.
+	readinessEnabled = readinessEnabled || config.ReadyFile != "" || len(config.Hooks.Hooks(HookPointPostReady)) > 0 || supervisorConfig.Watchdog.Enabled()
+
+	return &Volume{
+		config:             config,
+		supervisorConfig:   supervisorConfig,
+		readyProbeInterval: readyProbeInterval,
+		readinessEnabled:   readinessEnabled,
+		readiness:          NewReadiness(config.ReadyFile),
+		controlChannel:     config.ControlChannel != nil && *config.ControlChannel,
+		done:               make(chan struct{}),
+	}
+}
+
+func (v *Volume) Name() string {
+	return v.config.Name
+}
+
+// Run receives the fd from the CSI driver and runs the mounter until it exits or Stop is called.
+func (v *Volume) Run() error {
+	err := v.run()
+
+	v.mu.Lock()
+	v.err = err
+	v.mu.Unlock()
+	close(v.done)
+
+	return err
+}
+
+func (v *Volume) run() error {
+	v.notify(v.Status())
+
+	if err := v.runHooks(HookPointPreHandshake, nil); err != nil {
+		return err
+	}
+
+	// The timeout is checked in Config.Validate.
+	connectTimeout, _ := v.config.ParseConnectTimeout()
+	mc, err := PrepareMountConfig(v.config.FdPassingSocketPath, connectTimeout, nil)
+	if err != nil {
+		return fmt.Errorf("%w: socket path %q: %w", ErrHandshake, v.config.FdPassingSocketPath, err)
+	}
+
+	if err := v.runHooks(HookPointPostFdReceive, mc); err != nil {
+		syscall.Close(mc.FileDescriptor)
+		return err
+	}
+
+	mounter := New(v.config.MounterPath, v.config.Args)
+	mounter.Env = v.config.Environ()
+	if v.config.FuseFd != nil {
+		mounter.FdNumber = *v.config.FuseFd
+	}
+	mounter.FdEnvName = v.config.FuseFdEnv
+	mounter.Sandbox = v.config.Sandbox
+	mounter.UserNamespace = v.config.UserNamespace
+	mounter.LogCapture = v.newLogCapture(v.logName(mc))
+	klog.Infof("[%v] mounter(%s) args are %v", v.config.Name, v.config.MounterPath, v.config.Args)
+
+	supervisorConfig := v.supervisorConfig
+	supervisorConfig.OnStatusChange = func(status SupervisorStatus) {
+		v.onStatusChange(mc, status)
+	}
+
+	v.mu.Lock()
+	if v.stopped {
+		v.mu.Unlock()
+		syscall.Close(mc.FileDescriptor)
+		return nil
+	}
+	v.supervisor = NewSupervisor(mounter, mc, supervisorConfig)
+	v.mu.Unlock()
+
+	err = v.supervisor.Run()
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.abortErr != nil {
+		// The mounter was stopped because of the failed hook or the watchdog.
+		return v.abortErr
+	}
+	if v.stopped && err != nil {
+		// The mounter exited on SIGTERM, or SIGKILL after the grace period, sent by Stop. It is not a failure.
+		klog.Infof("[%v] mounter stopped: %v", v.config.Name, err)
+		return nil
+	}
+
+	return err
+}
+
+// report sends the state of the mounter to the CSI driver if the control channel is enabled.
+func (v *Volume) report(mc *MountConfig, r Report) {
+	if !v.controlChannel || mc.Token == "" {
+		return
+	}
+	if err := ReportStatus(v.config.FdPassingSocketPath, mc.Token, r); err != nil {
+		klog.Warningf("[%v] failed to report the state to the CSI driver: %v", v.config.Name, err)
+	}
+}
+
+func (v *Volume) newLogCapture(name string) *LogCapture {
+	// The format is checked in Config.Validate.
+	logFormat, _ := ParseLogFormat(v.config.LogFormat)
+	logBufferLines := DefaultLogBufferLines
+	if v.config.LogBufferLines != nil {
+		logBufferLines = *v.config.LogBufferLines
+	}
+
+	return NewLogCapture(name, logFormat, logBufferLines)
+}
+
+// runHooks runs the hooks at point with the environment of the mounter and the MountConfig.
+func (v *Volume) runHooks(point HookPoint, mc *MountConfig) error {
+	hooks := v.config.Hooks.Hooks(point)
+	if len(hooks) == 0 {
+		return nil
+	}
+
+	env, err := HookEnv(point, &v.config, mc)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrHook, err)
+	}
+
+	return RunHooks(hooks, point, append(v.config.Environ(), env...), v.newLogCapture(fmt.Sprintf("%s:%s", v.logName(mc), point)))
+}
+
+// logName returns the name prefixing the captured output, which is the volume name after the handshake.
+// mc is nil before the handshake.
+func (v *Volume) logName(mc *MountConfig) string {
+	if mc == nil || mc.VolumeName == "" {
+		return v.config.Name
+	}
+
+	return mc.VolumeName
+}
+
+// abort stops the mounter because of the failed postReady hook or the hung FUSE daemon.
+func (v *Volume) abort(err error) {
+	klog.Errorf("[%v] aborting mount: %v", v.config.Name, err)
+	v.readiness.Set(false)
+
+	v.mu.Lock()
+	if v.abortErr == nil {
+		v.abortErr = err
+	}
+	v.stopped = true
+	supervisor := v.supervisor
+	v.mu.Unlock()
+
+	if supervisor == nil {
+		return
+	}
+	if errors.Is(err, ErrHung) {
+		// The hung FUSE daemon does not handle SIGTERM, and the grace period may be disabled.
+		supervisor.Kill()
+	} else {
+		supervisor.Stop()
+	}
+}
+
+// Stop stops the mounter. A volume still waiting for the handshake will not start the mounter.
+func (v *Volume) Stop() {
+	v.readiness.Set(false)
+
+	v.mu.Lock()
+	v.stopped = true
+	supervisor := v.supervisor
+	v.mu.Unlock()
+
+	if supervisor != nil {
+		supervisor.Stop()
+	}
+}
+
+// Signal forwards sig to the running mounter.
+func (v *Volume) Signal(sig os.Signal) {
+	v.mu.Lock()
+	supervisor := v.supervisor
+	v.mu.Unlock()
+
+	if supervisor != nil {
+		supervisor.Signal(sig)
+	}
+}
+
+// Wait waits for the mounter to exit if it has been started.
+func (v *Volume) Wait() {
+	v.mu.Lock()
+	started := v.supervisor != nil
+	v.mu.Unlock()
+
+	if started {
+		<-v.done
+	}
+}
+
+// Err returns the error Run returned.
+func (v *Volume) Err() error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	return v.err
+}
+
+func (v *Volume) Status() SupervisorStatus {
+	v.mu.Lock()
+	supervisor := v.supervisor
+	v.mu.Unlock()
+
+	if supervisor == nil {
+		return SupervisorStatus{
+			VolumeName: v.config.Name,
+			State:      SupervisorStateHandshaking,
+		}
+	}
+
+	status := supervisor.Status()
+	status.VolumeName = v.config.Name
+
+	return status
+}
+
+func (v *Volume) Ready() bool {
+	return v.readiness.Ready()
+}
+
+func (v *Volume) notify(status SupervisorStatus) {
+	status.VolumeName = v.config.Name
+	if v.supervisorConfig.OnStatusChange != nil {
+		v.supervisorConfig.OnStatusChange(status)
+	}
+}
+
+// onStatusChange is called from the goroutine running the supervisor.
+func (v *Volume) onStatusChange(mc *MountConfig, status SupervisorStatus) {
+	v.notify(status)
+	// With readiness probes, the FUSE filesystem is reported to be ready after the probe succeeds.
+	running := status.State == SupervisorStateRunning
+	v.report(mc, Report{Ready: running && !v.readinessEnabled, Healthy: running, Message: string(status.State)})
+	if !v.readinessEnabled {
+		return
+	}
+
+	// The FUSE filesystem must be probed again whenever the mounter is (re)started.
+	if v.probeStopCh != nil {
+		close(v.probeStopCh)
+		v.probeStopCh = nil
+	}
+	v.readiness.Set(false)
+	if status.State == SupervisorStateRunning {
+		v.probeStopCh = make(chan struct{})
+		go func(stopCh chan struct{}) {
+			path, err := WaitForMount(mc, v.config.ReadyProbePath, v.readyProbeInterval, stopCh)
+			if err != nil {
+				klog.V(4).Info(err)
+				return
+			}
+			if err := v.runHooks(HookPointPostReady, mc); err != nil {
+				select {
+				case <-stopCh:
+					// The mounter was restarted or stopped while the hooks were running.
+				default:
+					v.abort(err)
+				}
+				return
+			}
+			select {
+			case <-stopCh:
+				return
+			default:
+				v.readiness.Set(true)
+				v.report(mc, Report{Ready: true, Healthy: true, Message: "ready"})
+			}
+
+			if v.supervisorConfig.Watchdog.Enabled() {
+				if err := Watch(path, v.supervisorConfig.Watchdog, stopCh); err != nil {
+					v.abort(fmt.Errorf("[%v] %w", v.config.Name, err))
+				}
+			}
+		}(v.probeStopCh)
+	}
+}
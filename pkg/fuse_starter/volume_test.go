@@ -0,0 +1,181 @@
+/*
+Copyright 2023 Preferred Networks, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fusestarter
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pfnet-research/meta-fuse-csi-plugin/pkg/util"
+)
+
+// serveFd mimics the CSI driver. It passes the read end of a pipe as the FUSE fd to the first client.
+func serveFd(t *testing.T, sockPath string, mc MountConfig) {
+	t.Helper()
+
+	l, err := net.Listen("unix", sockPath)
+	if err != nil {
+		t.Fatalf("failed to listen on %q: %v", sockPath, err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+
+		r, w, err := os.Pipe()
+		if err != nil {
+			return
+		}
+		defer r.Close()
+		defer w.Close()
+
+		msg, _ := json.Marshal(mc)
+		//nolint:errcheck
+		util.SendMsg(c, int(r.Fd()), msg)
+	}()
+}
+
+func TestVolumes(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	configs := []MounterConfig{
+		{
+			Name:                "ok",
+			FdPassingSocketPath: filepath.Join(dir, "ok.sock"),
+			MounterPath:         "/bin/sh",
+			// The mounter receives the fd and the environment.
+			Args: []string{"-c", `[ -e /dev/fd/3 ] && [ "$VOLUME" = ok ]`},
+			Env:  map[string]string{"VOLUME": "ok"},
+		},
+		{
+			Name:                "failed",
+			FdPassingSocketPath: filepath.Join(dir, "failed.sock"),
+			MounterPath:         "/bin/sh",
+			Args:                []string{"-c", "exit 2"},
+		},
+	}
+
+	volumes := []*Volume{}
+	for _, c := range configs {
+		serveFd(t, c.FdPassingSocketPath, MountConfig{VolumeName: c.Name})
+		volumes = append(volumes, NewVolume(c, SupervisorConfig{}, 0, false))
+	}
+
+	errCh := make(chan error, len(volumes))
+	for _, v := range volumes {
+		go func(v *Volume) { errCh <- v.Run() }(v)
+	}
+	for range volumes {
+		<-errCh
+	}
+
+	// A failing mounter does not affect the others.
+	if err := volumes[0].Err(); err != nil {
+		t.Errorf("Did not expect error for volume %q but got: %v", volumes[0].Name(), err)
+	}
+	if code := ExitCode(volumes[1].Err()); code != 2 {
+		t.Errorf("Got exit code %d for volume %q, but expected 2", code, volumes[1].Name())
+	}
+	if state := volumes[0].Status().State; state != SupervisorStateExited {
+		t.Errorf("Got state %v for volume %q, but expected %v", state, volumes[0].Name(), SupervisorStateExited)
+	}
+	if state := volumes[1].Status().State; state != SupervisorStateFailed {
+		t.Errorf("Got state %v for volume %q, but expected %v", state, volumes[1].Name(), SupervisorStateFailed)
+	}
+}
+
+func TestVolumeStopBeforeHandshake(t *testing.T) {
+	t.Parallel()
+
+	v := NewVolume(MounterConfig{Name: "never", FdPassingSocketPath: filepath.Join(t.TempDir(), "never.sock"), MounterPath: "/bin/true"}, SupervisorConfig{}, 0, false)
+	v.Stop()
+	// The mounter is not started, so Wait must not block.
+	v.Wait()
+
+	if state := v.Status().State; state != SupervisorStateHandshaking {
+		t.Errorf("Got state %v, but expected %v", state, SupervisorStateHandshaking)
+	}
+}
+
+func TestVolumeStop(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	config := MounterConfig{
+		Name:                "stopped",
+		FdPassingSocketPath: filepath.Join(dir, "stopped.sock"),
+		MounterPath:         "/bin/sleep",
+		Args:                []string{"10"},
+	}
+	serveFd(t, config.FdPassingSocketPath, MountConfig{VolumeName: config.Name})
+	v := NewVolume(config, SupervisorConfig{}, 0, false)
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- v.Run() }()
+	for i := 0; v.Status().State != SupervisorStateRunning; i++ {
+		if i > 100 {
+			t.Fatalf("mounter did not start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The mounter killed by SIGTERM of Stop is not a failure.
+	v.Stop()
+	if err := <-errCh; err != nil {
+		t.Errorf("Did not expect error but got: %v", err)
+	}
+	if code := ExitCode(v.Err()); code != 0 {
+		t.Errorf("Got exit code %d, but expected 0", code)
+	}
+}
+
+func TestVolumeLogName(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name         string
+		mc           *MountConfig
+		expectedName string
+	}{
+		{
+			name:         "should use the mounter name before the handshake",
+			expectedName: "mounter",
+		},
+		{
+			name:         "should use the volume name after the handshake",
+			mc:           &MountConfig{VolumeName: "test-volume"},
+			expectedName: "test-volume",
+		},
+	}
+
+	v := NewVolume(MounterConfig{Name: "mounter"}, SupervisorConfig{}, 0, false)
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		if name := v.logName(tc.mc); name != tc.expectedName {
+			t.Errorf("Got name %q, but expected %q", name, tc.expectedName)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+/*
+Copyright 2023 Preferred Networks, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fusestarter
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// ErrHung is wrapped by the error of the watchdog detecting a hung FUSE daemon.
+var ErrHung = errors.New("FUSE daemon is hung")
+
+// WatchdogConfig configures the liveness watchdog of the FUSE filesystem.
+type WatchdogConfig struct {
+	// Interval is the interval of probes. Zero disables the watchdog.
+	Interval time.Duration
+	// Timeout is the time a probe is allowed to take.
+	Timeout time.Duration
+	// FailureThreshold is the number of consecutive timeouts to declare the FUSE daemon hung.
+	FailureThreshold int
+}
+
+func (c *WatchdogConfig) Enabled() bool {
+	return c.Interval > 0
+}
+
+// Watch probes the FUSE filesystem at path with statfs(2) every interval until stopCh is closed.
+// It returns an error wrapping ErrHung after FailureThreshold consecutive timeouts.
+// statfs(2) on a hung FUSE filesystem blocks forever, so the probe runs in another goroutine,
+// and a new probe is not started while the previous one is blocked.
+func Watch(path string, config WatchdogConfig, stopCh <-chan struct{}) error {
+	return watch(path, func() error {
+		var st syscall.Statfs_t
+		return syscall.Statfs(path, &st)
+	}, config, stopCh)
+}
+
+func watch(path string, probe func() error, config WatchdogConfig, stopCh <-chan struct{}) error {
+	var pending chan error
+	failures := 0
+	for {
+		if pending == nil {
+			pending = make(chan error, 1)
+			go func(result chan<- error) {
+				result <- probe()
+			}(pending)
+		}
+
+		select {
+		case err := <-pending:
+			pending = nil
+			if failures > 0 {
+				klog.Infof("FUSE filesystem at %q answered after %d timeouts", path, failures)
+			}
+			failures = 0
+			if err != nil {
+				// The mounter exiting is handled by the supervisor. Only hangs are the concern here.
+				klog.V(4).Infof("watchdog probe on %q failed: %v", path, err)
+			}
+		case <-time.After(config.Timeout):
+			failures++
+			klog.Warningf("statfs on %q did not return within %v (%d/%d)", path, config.Timeout, failures, config.FailureThreshold)
+			if failures >= config.FailureThreshold {
+				return fmt.Errorf("%w: statfs on %q did not return within %v %d times in a row", ErrHung, path, config.Timeout, failures)
+			}
+		case <-stopCh:
+			return nil
+		}
+
+		select {
+		case <-time.After(config.Interval):
+		case <-stopCh:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2023 Preferred Networks, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fusestarter
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWatch(t *testing.T) {
+	t.Parallel()
+
+	config := WatchdogConfig{
+		Interval:         10 * time.Millisecond,
+		Timeout:          20 * time.Millisecond,
+		FailureThreshold: 3,
+	}
+	// done releases the blocked probes when the test ends.
+	done := make(chan struct{})
+	defer close(done)
+
+	testCases := []struct {
+		name          string
+		probe         func(calls int32) error
+		expectedHung  bool
+		expectedCalls int32
+	}{
+		{
+			name: "should detect the hung FUSE daemon without starting another probe",
+			probe: func(int32) error {
+				<-done
+				return nil
+			},
+			expectedHung: true,
+			// The blocked probe is waited instead of starting new ones.
+			expectedCalls: 1,
+		},
+		{
+			name: "should reset the failures when the probe returns",
+			probe: func(calls int32) error {
+				// Every other probe takes longer than the timeout.
+				if calls%2 == 1 {
+					time.Sleep(30 * time.Millisecond)
+				}
+				return nil
+			},
+			expectedHung: false,
+		},
+		{
+			name:         "should ignore errors other than timeouts",
+			probe:        func(int32) error { return errors.New("transport endpoint is not connected") },
+			expectedHung: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		// The probes may outlive the iteration.
+		tc := tc
+		t.Logf("test case: %s", tc.name)
+
+		var calls int32
+		probe := func() error {
+			return tc.probe(atomic.AddInt32(&calls, 1))
+		}
+		stopCh := make(chan struct{})
+		time.AfterFunc(time.Second, func() { close(stopCh) })
+
+		err := watch("/test", probe, config, stopCh)
+		if tc.expectedHung {
+			if !errors.Is(err, ErrHung) {
+				t.Errorf("Got error %v, but expected %v", err, ErrHung)
+			}
+			if code := ExitCode(err); code != ExitCodeHung {
+				t.Errorf("Got exit code %d, but expected %d", code, ExitCodeHung)
+			}
+		} else if err != nil {
+			t.Errorf("Did not expect error but got: %v", err)
+		}
+		if tc.expectedCalls > 0 && atomic.LoadInt32(&calls) != tc.expectedCalls {
+			t.Errorf("Got %d probes, but expected %d", atomic.LoadInt32(&calls), tc.expectedCalls)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+/*
+Copyright 2023 Preferred Networks, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fusermount3proxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	starter "github.com/pfnet-research/meta-fuse-csi-plugin/pkg/fuse_starter"
+	"k8s.io/klog/v2"
+)
+
+// AutoUnmount waits for the FUSE daemon to close its end of commConn, i.e. to exit or crash,
+// and asks the CSI driver via the fd-passing socket to unmount mntPoint lazily like fusermount3 with auto_unmount.
+// tokenPath is the file of token saved on mount. The filesystem is regarded as already unmounted
+// by fusermount3-proxy -u if the file does not exist.
+func AutoUnmount(commConn net.Conn, mntPoint, fdPassingSocketPath, tokenPath, token string) error {
+	klog.Infof("waiting for the FUSE daemon to exit to unmount %q", mntPoint)
+	buf := make([]byte, 1)
+	for {
+		if _, err := commConn.Read(buf); err != nil {
+			break
+		}
+	}
+
+	// fusermount3-proxy -u removes the token after unmount.
+	if _, err := os.Stat(tokenPath); os.IsNotExist(err) {
+		klog.Infof("%q is already unmounted", mntPoint)
+		return nil
+	}
+	if err := starter.RequestUnmount(fdPassingSocketPath, token, true); err != nil {
+		return fmt.Errorf("failed to unmount %s: %w", mntPoint, err)
+	}
+	if err := os.Remove(tokenPath); err != nil {
+		klog.Warningf("failed to remove the token of the mount: %v", err)
+	}
+	klog.Infof("unmounted %q after the FUSE daemon exited", mntPoint)
+
+	return nil
+}
@@ -0,0 +1,145 @@
+/*
+Copyright 2023 Preferred Networks, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fusermount3proxy
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	starter "github.com/pfnet-research/meta-fuse-csi-plugin/pkg/fuse_starter"
+)
+
+func TestAutoUnmount(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name            string
+		unmounted       bool
+		response        starter.Response
+		expectedRequest bool
+		expectedError   string
+	}{
+		{
+			name:            "should request lazy unmount when the FUSE daemon closes the comm socket",
+			expectedRequest: true,
+		},
+		{
+			name:      "should not request unmount when fusermount3-proxy -u already unmounted",
+			unmounted: true,
+		},
+		{
+			name:            "should return error when the driver refused",
+			response:        starter.Response{Error: "token does not match the one of the mount"},
+			expectedRequest: true,
+			expectedError:   "token does not match the one of the mount",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+
+		dir := t.TempDir()
+		sp := filepath.Join(dir, "test.sock")
+		tokenPath := sp + ".token"
+		if !tc.unmounted {
+			if err := os.WriteFile(tokenPath, []byte("token"), 0o600); err != nil {
+				t.Fatalf("failed to write the token: %v", err)
+			}
+		}
+		l, err := net.Listen("unix", sp)
+		if err != nil {
+			t.Fatalf("failed to listen on %q: %v", sp, err)
+		}
+		reqCh := make(chan starter.Request, 1)
+		go func(resp starter.Response) {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+			req := starter.Request{}
+			if err := json.NewDecoder(c).Decode(&req); err != nil {
+				t.Errorf("failed to decode the request: %v", err)
+				return
+			}
+			reqCh <- req
+			b, _ := json.Marshal(resp)
+			c.Write(b)
+		}(tc.response)
+
+		// libfuse creates the comm socket with socketpair(2).
+		fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+		if err != nil {
+			t.Fatalf("failed to create a socket pair: %v", err)
+		}
+		f := os.NewFile(uintptr(fds[0]), "commfd")
+		commConn, err := net.FileConn(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("failed to create net.Conn: %v", err)
+		}
+
+		errCh := make(chan error, 1)
+		go func() { errCh <- AutoUnmount(commConn, "/mnt", sp, tokenPath, "token") }()
+		select {
+		case err := <-errCh:
+			t.Errorf("Expected to wait for the FUSE daemon but returned: %v", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+		// The FUSE daemon exits.
+		syscall.Close(fds[1])
+
+		err = <-errCh
+		commConn.Close()
+		l.Close()
+		if tc.expectedError != "" {
+			if err == nil {
+				t.Errorf("Expected error but got none")
+			} else if !strings.Contains(err.Error(), tc.expectedError) {
+				t.Errorf("Got error %q, but expected to contain %q", err, tc.expectedError)
+			}
+		} else if err != nil {
+			t.Errorf("Did not expect error but got: %v", err)
+		}
+
+		select {
+		case req := <-reqCh:
+			expected := starter.Request{Op: starter.RequestOpUnmount, Token: "token", Lazy: true}
+			if !tc.expectedRequest {
+				t.Errorf("Expected no request but got %+v", req)
+			} else if !reflect.DeepEqual(req, expected) {
+				t.Errorf("Got request %+v, but expected %+v", req, expected)
+			}
+		default:
+			if tc.expectedRequest {
+				t.Errorf("Expected an unmount request but got none")
+			}
+		}
+
+		_, err = os.Stat(tokenPath)
+		if removed := os.IsNotExist(err); removed != (tc.expectedError == "") {
+			t.Errorf("Got token removed %v, but expected %v", removed, tc.expectedError == "")
+		}
+	}
+}
@@ -0,0 +1,61 @@
+/*
+Copyright 2023 Preferred Networks, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fusermount3proxy
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"strconv"
+
+	"github.com/pfnet-research/meta-fuse-csi-plugin/pkg/util"
+)
+
+const (
+	// EnvCommFd is the environment variable where libfuse passes the comm socket to fusermount3.
+	// fusermount of libfuse2 receives it in the same way.
+	EnvCommFd = "_FUSE_COMMFD"
+
+	// Fuse2ProgName is the name of fusermount of libfuse2.
+	// fusermount3-proxy emulates it when it is invoked with the name, e.g. via a symlink.
+	Fuse2ProgName = "fusermount"
+)
+
+// IsFuse2 returns true if fusermount3-proxy is invoked as fusermount of libfuse2.
+func IsFuse2(progName string) bool {
+	return filepath.Base(progName) == Fuse2ProgName
+}
+
+// CommConn returns the comm socket of libfuse from the value of EnvCommFd.
+func CommConn(commFd string) (net.Conn, error) {
+	fd, err := strconv.Atoi(commFd)
+	if err != nil || fd < 0 {
+		return nil, fmt.Errorf("invalid %s=%q", EnvCommFd, commFd)
+	}
+	conn, err := util.GetNetConnFromRawUnixSocketFd(fd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert %s=%d to net.Conn: %w", EnvCommFd, fd, err)
+	}
+
+	return conn, nil
+}
+
+// SendFuseFd sends the FUSE fd to libfuse via the comm socket.
+// Both libfuse2 and libfuse3 expect the fd with a single zero byte.
+func SendFuseFd(conn net.Conn, fd int) error {
+	return util.SendMsg(conn, fd, []byte{0})
+}
@@ -0,0 +1,148 @@
+/*
+Copyright 2023 Preferred Networks, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fusermount3proxy
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/pfnet-research/meta-fuse-csi-plugin/pkg/util"
+)
+
+func TestIsFuse2(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name          string
+		progName      string
+		expectedFuse2 bool
+	}{
+		{
+			name:          "should emulate libfuse2 as fusermount",
+			progName:      "/usr/bin/fusermount",
+			expectedFuse2: true,
+		},
+		{
+			name:     "should emulate libfuse3 as fusermount3",
+			progName: "/usr/bin/fusermount3",
+		},
+		{
+			name:     "should emulate libfuse3 as fusermount3-proxy",
+			progName: "fusermount3-proxy",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		if fuse2 := IsFuse2(tc.progName); fuse2 != tc.expectedFuse2 {
+			t.Errorf("Got %v, but expected %v", fuse2, tc.expectedFuse2)
+		}
+	}
+}
+
+func TestCommConn(t *testing.T) {
+	t.Parallel()
+
+	p := make([]int, 2)
+	if err := syscall.Pipe(p); err != nil {
+		t.Fatalf("failed to create a pipe: %v", err)
+	}
+	defer syscall.Close(p[0])
+	defer syscall.Close(p[1])
+
+	testCases := []struct {
+		name          string
+		commFd        func(t *testing.T) (string, net.Conn)
+		expectedError bool
+	}{
+		{
+			// libfuse2 and libfuse3 create the comm socket with socketpair(2).
+			name: "should send the FUSE fd via the comm socket of libfuse",
+			commFd: func(t *testing.T) (string, net.Conn) {
+				fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+				if err != nil {
+					t.Fatalf("failed to create a socket pair: %v", err)
+				}
+				f := os.NewFile(uintptr(fds[1]), "libfuse")
+				defer f.Close()
+				libfuse, err := net.FileConn(f)
+				if err != nil {
+					t.Fatalf("failed to convert the socket to net.Conn: %v", err)
+				}
+
+				return strconv.Itoa(fds[0]), libfuse
+			},
+		},
+		{
+			name: "should return error for an invalid fd",
+			commFd: func(_ *testing.T) (string, net.Conn) {
+				return "fd", nil
+			},
+			expectedError: true,
+		},
+		{
+			name: "should return error for an fd not a socket",
+			commFd: func(_ *testing.T) (string, net.Conn) {
+				fd, err := syscall.Dup(p[0])
+				if err != nil {
+					t.Fatalf("failed to duplicate the pipe: %v", err)
+				}
+
+				return strconv.Itoa(fd), nil
+			},
+			expectedError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+
+		commFd, libfuse := tc.commFd(t)
+		conn, err := CommConn(commFd)
+		if tc.expectedError {
+			if err == nil {
+				t.Errorf("Expected error but got none")
+				conn.Close()
+			}
+
+			continue
+		}
+		if err != nil {
+			t.Errorf("Did not expect error but got: %v", err)
+
+			continue
+		}
+
+		if err := SendFuseFd(conn, p[0]); err != nil {
+			t.Errorf("Did not expect error but got: %v", err)
+		}
+		fd, msg, err := util.RecvMsg(libfuse)
+		if err != nil {
+			t.Errorf("Did not expect error but got: %v", err)
+		} else {
+			syscall.Close(fd)
+			if string(msg) != "\x00" {
+				t.Errorf("Got message %q, but expected a zero byte", msg)
+			}
+		}
+		conn.Close()
+		libfuse.Close()
+	}
+}
@@ -0,0 +1,131 @@
+/*
+Copyright 2023 Preferred Networks, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fusermount3proxy
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// InstallCommand is the subcommand of fusermount3-proxy which installs itself into a shared directory.
+	InstallCommand = "install"
+
+	// BinaryName is the name of the installed binary. fusermount3 and fusermount are linked to it.
+	BinaryName = "fusermount3-proxy"
+	// FusePlaceholderName is the name of the placeholder of /dev/fuse.
+	// libfuse falls back to fusermount3 only when it can open /dev/fuse but mount(2) fails.
+	FusePlaceholderName = "fuse"
+
+	selfExePath = "/proc/self/exe"
+)
+
+// Install copies the running binary into dir with fusermount3 and fusermount links to it,
+// creates the placeholder of /dev/fuse, and writes how to configure the FUSE container to out.
+// sockPath is shown in the instructions if not empty.
+func Install(dir string, sockPath string, out io.Writer) error {
+	return install(selfExePath, dir, sockPath, out)
+}
+
+func install(exePath, dir, sockPath string, out io.Writer) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create directory %q: %w", dir, err)
+	}
+
+	binPath := filepath.Join(dir, BinaryName)
+	if err := copyExecutable(exePath, binPath); err != nil {
+		return err
+	}
+
+	// The links are relative to keep working wherever the directory is mounted.
+	for _, name := range []string{"fusermount3", "fusermount"} {
+		link := filepath.Join(dir, name)
+		if err := os.Remove(link); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove %q: %w", link, err)
+		}
+		if err := os.Symlink(BinaryName, link); err != nil {
+			return fmt.Errorf("failed to create link %q: %w", link, err)
+		}
+	}
+
+	placeholder := filepath.Join(dir, FusePlaceholderName)
+	f, err := os.OpenFile(placeholder, os.O_CREATE|os.O_WRONLY, 0o666)
+	if err != nil {
+		return fmt.Errorf("failed to create %q: %w", placeholder, err)
+	}
+	f.Close()
+	// The FUSE implementation may run as any user. Ignore umask.
+	if err := os.Chmod(placeholder, 0o666); err != nil {
+		return fmt.Errorf("failed to change the mode of %q: %w", placeholder, err)
+	}
+
+	if sockPath == "" {
+		sockPath = "<path to the fd-passing socket>"
+	}
+	fmt.Fprintf(out, `fusermount3-proxy is installed in %[1]s.
+Configure the FUSE container as follows, mounting the same volume at %[1]s:
+  env:
+  - name: PATH
+    value: "%[1]s:/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+  - name: FUSERMOUNT3PROXY_FDPASSING_SOCKPATH
+    value: "%[2]s"
+  volumeMounts:
+  - name: <volume of %[1]s>
+    mountPath: %[1]s
+  - name: <volume of %[1]s>
+    mountPath: /dev/fuse
+    subPath: %[3]s
+libfuse runs /usr/bin/fusermount3 (/bin/fusermount for libfuse2) in preference to PATH.
+If the image has it, also mount the volume with subPath %[4]s at the path.
+`, dir, sockPath, FusePlaceholderName, BinaryName)
+
+	return nil
+}
+
+// copyExecutable copies src to dst atomically, so that a running dst is not overwritten.
+func copyExecutable(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open %q: %w", src, err)
+	}
+	defer in.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(dst), "."+filepath.Base(dst))
+	if err != nil {
+		return fmt.Errorf("failed to create a temporary file in %q: %w", filepath.Dir(dst), err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, in); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to copy %q to %q: %w", src, tmp.Name(), err)
+	}
+	if err := tmp.Chmod(0o755); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to change the mode of %q: %w", tmp.Name(), err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write %q: %w", tmp.Name(), err)
+	}
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		return fmt.Errorf("failed to rename %q to %q: %w", tmp.Name(), dst, err)
+	}
+
+	return nil
+}
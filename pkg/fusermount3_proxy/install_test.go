@@ -0,0 +1,82 @@
+/*
+Copyright 2023 Preferred Networks, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fusermount3proxy
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestInstall(t *testing.T) {
+	t.Parallel()
+
+	exePath := filepath.Join(t.TempDir(), "exe")
+	if err := os.WriteFile(exePath, []byte("binary"), 0o700); err != nil {
+		t.Fatalf("failed to write %q: %v", exePath, err)
+	}
+	dir := filepath.Join(t.TempDir(), "bin")
+
+	// Installing twice, e.g. on restart of the init container, should succeed.
+	for i := 0; i < 2; i++ {
+		out := bytes.Buffer{}
+		if err := install(exePath, dir, "/fuse-fd-passing/fuse.sock", &out); err != nil {
+			t.Fatalf("Did not expect error but got: %v", err)
+		}
+		if !strings.Contains(out.String(), "/fuse-fd-passing/fuse.sock") {
+			t.Errorf("Got instructions %q, but expected to contain the socket path", out.String())
+		}
+	}
+
+	b, err := os.ReadFile(filepath.Join(dir, BinaryName))
+	if err != nil {
+		t.Fatalf("failed to read the installed binary: %v", err)
+	}
+	if string(b) != "binary" {
+		t.Errorf("Got binary %q, but expected %q", b, "binary")
+	}
+	if fi, err := os.Stat(filepath.Join(dir, BinaryName)); err != nil || fi.Mode().Perm() != 0o755 {
+		t.Errorf("Got the installed binary %v (%v), but expected mode 0755", fi, err)
+	}
+
+	for _, name := range []string{"fusermount3", "fusermount"} {
+		target, err := os.Readlink(filepath.Join(dir, name))
+		if err != nil {
+			t.Errorf("failed to read link %q: %v", name, err)
+		} else if target != BinaryName {
+			t.Errorf("Got link %q to %q, but expected %q", name, target, BinaryName)
+		}
+	}
+
+	fi, err := os.Stat(filepath.Join(dir, FusePlaceholderName))
+	if err != nil {
+		t.Fatalf("failed to stat the placeholder: %v", err)
+	}
+	if fi.Mode().Perm() != 0o666 {
+		t.Errorf("Got placeholder mode %v, but expected 0666", fi.Mode().Perm())
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("failed to read %q: %v", dir, err)
+	}
+	if len(entries) != 4 {
+		t.Errorf("Got %d files, but expected no temporary file left", len(entries))
+	}
+}
@@ -0,0 +1,39 @@
+/*
+Copyright 2023 Preferred Networks, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fusermount3proxy
+
+import "strings"
+
+// ParseOptions splits the comma-separated options of "-o" into the mount options requested to the CSI driver.
+// auto_unmount is handled by fusermount3-proxy itself and reported separately.
+// With fuse2, "nonempty" of libfuse2 is dropped, since it only skips the check of fusermount that the mountpoint is empty.
+func ParseOptions(options string, fuse2 bool) ([]string, bool) {
+	requested := []string{}
+	autoUnmount := false
+	for _, o := range strings.Split(options, ",") {
+		switch {
+		case o == "":
+		case o == "auto_unmount":
+			autoUnmount = true
+		case fuse2 && o == "nonempty":
+		default:
+			requested = append(requested, o)
+		}
+	}
+
+	return requested, autoUnmount
+}
@@ -0,0 +1,74 @@
+/*
+Copyright 2023 Preferred Networks, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fusermount3proxy
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseOptions(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name                string
+		options             string
+		fuse2               bool
+		expectedOptions     []string
+		expectedAutoUnmount bool
+	}{
+		{
+			name:            "should split options",
+			options:         "rw,nosuid,nodev,subtype=sshfs,fsname=user@host:/",
+			expectedOptions: []string{"rw", "nosuid", "nodev", "subtype=sshfs", "fsname=user@host:/"},
+		},
+		{
+			name:                "should take auto_unmount",
+			options:             "rw,auto_unmount",
+			expectedOptions:     []string{"rw"},
+			expectedAutoUnmount: true,
+		},
+		{
+			name:            "should keep nonempty for libfuse3",
+			options:         "rw,nonempty",
+			expectedOptions: []string{"rw", "nonempty"},
+		},
+		{
+			name:            "should drop nonempty for libfuse2",
+			options:         "rw,nonempty",
+			fuse2:           true,
+			expectedOptions: []string{"rw"},
+		},
+		{
+			name:            "should return no options for an empty string",
+			options:         "",
+			expectedOptions: []string{},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+
+		options, autoUnmount := ParseOptions(tc.options, tc.fuse2)
+		if !reflect.DeepEqual(options, tc.expectedOptions) {
+			t.Errorf("Got options %v, but expected %v", options, tc.expectedOptions)
+		}
+		if autoUnmount != tc.expectedAutoUnmount {
+			t.Errorf("Got auto_unmount %v, but expected %v", autoUnmount, tc.expectedAutoUnmount)
+		}
+	}
+}
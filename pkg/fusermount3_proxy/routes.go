@@ -0,0 +1,147 @@
+/*
+Copyright 2023 Preferred Networks, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fusermount3proxy
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// Config is the configuration file of fusermount3-proxy.
+type Config struct {
+	Mounts []Mount `json:"mounts"`
+}
+
+// Mount maps a mountpoint in the container to the fd-passing socket of the volume mounted there.
+type Mount struct {
+	MountPoint          string `json:"mountPoint"`
+	FdPassingSocketPath string `json:"fdPassingSocketPath"`
+}
+
+// Routes resolves the fd-passing socket for a mountpoint.
+type Routes struct {
+	// sockets is keyed by the absolute mountpoint.
+	sockets map[string]string
+	// fallback is the socket for any mountpoint when no mount is mapped.
+	fallback string
+}
+
+// LoadConfig reads the configuration file in YAML or JSON.
+func LoadConfig(path string) (*Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config %q: %w", path, err)
+	}
+
+	c := Config{}
+	// JSON is also YAML. The fields are decoded by their json tags.
+	if err := yaml.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal config %q: %w", path, err)
+	}
+
+	return &c, nil
+}
+
+// ParseMounts parses mounts in the form of "<mountpoint>=<socket path>,...".
+func ParseMounts(s string) ([]Mount, error) {
+	mounts := []Mount{}
+	for _, entry := range strings.Split(s, ",") {
+		if entry == "" {
+			continue
+		}
+		mountPoint, sockPath, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("mount %q is not in the form of <mountpoint>=<socket path>", entry)
+		}
+		mounts = append(mounts, Mount{MountPoint: mountPoint, FdPassingSocketPath: sockPath})
+	}
+
+	return mounts, nil
+}
+
+// NewRoutes returns Routes for mounts.
+// fallback is used for any mountpoint only if mounts is empty, for the single volume setup.
+func NewRoutes(mounts []Mount, fallback string) (*Routes, error) {
+	r := &Routes{
+		sockets:  map[string]string{},
+		fallback: fallback,
+	}
+
+	mountPoints := map[string]string{}
+	for i, m := range mounts {
+		if m.MountPoint == "" {
+			return nil, fmt.Errorf("mounts[%d]: mountPoint is not specified", i)
+		}
+		if m.FdPassingSocketPath == "" {
+			return nil, fmt.Errorf("mounts[%d]: fdPassingSocketPath is not specified", i)
+		}
+		mountPoint, err := absPath("mountpoint", m.MountPoint)
+		if err != nil {
+			return nil, fmt.Errorf("mounts[%d]: %w", i, err)
+		}
+		if _, ok := r.sockets[mountPoint]; ok {
+			return nil, fmt.Errorf("mounts[%d]: mountpoint %q is mapped more than once", i, m.MountPoint)
+		}
+		// A daemon must not receive the fd of another volume.
+		sockPath, err := absPath("socket", m.FdPassingSocketPath)
+		if err != nil {
+			return nil, fmt.Errorf("mounts[%d]: %w", i, err)
+		}
+		if other, ok := mountPoints[sockPath]; ok {
+			return nil, fmt.Errorf("mounts[%d]: socket %q is already mapped to mountpoint %q", i, m.FdPassingSocketPath, other)
+		}
+		r.sockets[mountPoint] = sockPath
+		mountPoints[sockPath] = m.MountPoint
+	}
+
+	if len(r.sockets) == 0 && r.fallback == "" {
+		return nil, fmt.Errorf("no fd-passing socket is specified")
+	}
+
+	return r, nil
+}
+
+// SocketPath returns the fd-passing socket for mountPoint. It returns an error for a mountpoint without a mapping.
+func (r *Routes) SocketPath(mountPoint string) (string, error) {
+	if len(r.sockets) == 0 {
+		return r.fallback, nil
+	}
+
+	p, err := absPath("mountpoint", mountPoint)
+	if err != nil {
+		return "", err
+	}
+	sockPath, ok := r.sockets[p]
+	if !ok {
+		return "", fmt.Errorf("mountpoint %q is not mapped to any fd-passing socket", mountPoint)
+	}
+
+	return sockPath, nil
+}
+
+func absPath(kind, path string) (string, error) {
+	p, err := filepath.Abs(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to get the absolute path of %s %q: %w", kind, path, err)
+	}
+
+	return p, nil
+}
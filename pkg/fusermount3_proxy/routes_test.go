@@ -0,0 +1,262 @@
+/*
+Copyright 2023 Preferred Networks, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fusermount3proxy
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseMounts(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name           string
+		input          string
+		expectedMounts []Mount
+		expectedError  bool
+	}{
+		{
+			name:  "should parse mounts",
+			input: "/mnt/a=/fuse-fd-passing-a/fuse.sock,/mnt/b=/fuse-fd-passing-b/fuse.sock",
+			expectedMounts: []Mount{
+				{MountPoint: "/mnt/a", FdPassingSocketPath: "/fuse-fd-passing-a/fuse.sock"},
+				{MountPoint: "/mnt/b", FdPassingSocketPath: "/fuse-fd-passing-b/fuse.sock"},
+			},
+		},
+		{
+			name:           "should return no mounts for an empty string",
+			input:          "",
+			expectedMounts: []Mount{},
+		},
+		{
+			name:          "should return error for a mount without socket path",
+			input:         "/mnt/a",
+			expectedError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+
+		mounts, err := ParseMounts(tc.input)
+		if tc.expectedError {
+			if err == nil {
+				t.Errorf("Expected error but got none")
+			}
+
+			continue
+		}
+		if err != nil {
+			t.Errorf("Did not expect error but got: %v", err)
+			continue
+		}
+		if !reflect.DeepEqual(mounts, tc.expectedMounts) {
+			t.Errorf("Got mounts %v, but expected %v", mounts, tc.expectedMounts)
+		}
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name           string
+		config         string
+		expectedMounts []Mount
+		expectedError  bool
+	}{
+		{
+			name: "should load mounts in JSON",
+			config: `{"mounts": [
+				{"mountPoint": "/mnt/a", "fdPassingSocketPath": "/fuse-fd-passing-a/fuse.sock"},
+				{"mountPoint": "/mnt/b", "fdPassingSocketPath": "/fuse-fd-passing-b/fuse.sock"}
+			]}`,
+			expectedMounts: []Mount{
+				{MountPoint: "/mnt/a", FdPassingSocketPath: "/fuse-fd-passing-a/fuse.sock"},
+				{MountPoint: "/mnt/b", FdPassingSocketPath: "/fuse-fd-passing-b/fuse.sock"},
+			},
+		},
+		{
+			name: "should load mounts in YAML like fuse-starter",
+			config: `mounts:
+- mountPoint: /mnt/a
+  fdPassingSocketPath: /fuse-fd-passing-a/fuse.sock
+- mountPoint: /mnt/b
+  fdPassingSocketPath: /fuse-fd-passing-b/fuse.sock
+`,
+			expectedMounts: []Mount{
+				{MountPoint: "/mnt/a", FdPassingSocketPath: "/fuse-fd-passing-a/fuse.sock"},
+				{MountPoint: "/mnt/b", FdPassingSocketPath: "/fuse-fd-passing-b/fuse.sock"},
+			},
+		},
+		{
+			name:          "should return error for a malformed config",
+			config:        `mounts: {`,
+			expectedError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		if err := os.WriteFile(path, []byte(tc.config), 0o600); err != nil {
+			t.Fatalf("failed to write config: %v", err)
+		}
+
+		c, err := LoadConfig(path)
+		if tc.expectedError && err == nil {
+			t.Errorf("Expected error but got none")
+		}
+		if err != nil {
+			if !tc.expectedError {
+				t.Errorf("Did not expect error but got: %v", err)
+			}
+
+			continue
+		}
+
+		if !reflect.DeepEqual(c.Mounts, tc.expectedMounts) {
+			t.Errorf("Got mounts %v, but expected %v", c.Mounts, tc.expectedMounts)
+		}
+	}
+}
+
+func TestNewRoutes(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name          string
+		mounts        []Mount
+		fallback      string
+		expectedError bool
+	}{
+		{
+			name:   "should accept mounts",
+			mounts: []Mount{{MountPoint: "/mnt/a", FdPassingSocketPath: "/a.sock"}, {MountPoint: "/mnt/b", FdPassingSocketPath: "/b.sock"}},
+		},
+		{
+			name:     "should accept the fallback only",
+			fallback: "/a.sock",
+		},
+		{
+			name:          "should return error for neither mounts nor fallback",
+			expectedError: true,
+		},
+		{
+			name:          "should return error for a mount without mountpoint",
+			mounts:        []Mount{{FdPassingSocketPath: "/a.sock"}},
+			expectedError: true,
+		},
+		{
+			name:          "should return error for a mountpoint mapped twice",
+			mounts:        []Mount{{MountPoint: "/mnt/a", FdPassingSocketPath: "/a.sock"}, {MountPoint: "/mnt/a/", FdPassingSocketPath: "/b.sock"}},
+			expectedError: true,
+		},
+		{
+			name:          "should return error for a socket shared by mountpoints",
+			mounts:        []Mount{{MountPoint: "/mnt/a", FdPassingSocketPath: "/a.sock"}, {MountPoint: "/mnt/b", FdPassingSocketPath: "/a.sock"}},
+			expectedError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+
+		_, err := NewRoutes(tc.mounts, tc.fallback)
+		if tc.expectedError {
+			if err == nil {
+				t.Errorf("Expected error but got none")
+			}
+		} else if err != nil {
+			t.Errorf("Did not expect error but got: %v", err)
+		}
+	}
+}
+
+func TestRoutesSocketPath(t *testing.T) {
+	t.Parallel()
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("failed to get the current directory: %v", err)
+	}
+
+	testCases := []struct {
+		name             string
+		mounts           []Mount
+		fallback         string
+		mountPoint       string
+		expectedSockPath string
+		expectedError    bool
+	}{
+		{
+			name:             "should return the socket mapped to the mountpoint",
+			mounts:           []Mount{{MountPoint: "/mnt/a", FdPassingSocketPath: "/a.sock"}, {MountPoint: "/mnt/b", FdPassingSocketPath: "/b.sock"}},
+			mountPoint:       "/mnt/b/",
+			expectedSockPath: "/b.sock",
+		},
+		{
+			name:             "should resolve a relative mountpoint",
+			mounts:           []Mount{{MountPoint: filepath.Join(wd, "mnt"), FdPassingSocketPath: "/a.sock"}},
+			mountPoint:       "mnt",
+			expectedSockPath: "/a.sock",
+		},
+		{
+			name:          "should reject a mountpoint without mapping",
+			mounts:        []Mount{{MountPoint: "/mnt/a", FdPassingSocketPath: "/a.sock"}},
+			fallback:      "/fallback.sock",
+			mountPoint:    "/mnt/c",
+			expectedError: true,
+		},
+		{
+			name:             "should return the fallback without mounts",
+			fallback:         "/fallback.sock",
+			mountPoint:       "/mnt/c",
+			expectedSockPath: "/fallback.sock",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+
+		r, err := NewRoutes(tc.mounts, tc.fallback)
+		if err != nil {
+			t.Errorf("Did not expect error but got: %v", err)
+			continue
+		}
+
+		sockPath, err := r.SocketPath(tc.mountPoint)
+		if tc.expectedError {
+			if err == nil {
+				t.Errorf("Expected error but got none")
+			}
+
+			continue
+		}
+		if err != nil {
+			t.Errorf("Did not expect error but got: %v", err)
+			continue
+		}
+		if sockPath != tc.expectedSockPath {
+			t.Errorf("Got socket path %q, but expected %q", sockPath, tc.expectedSockPath)
+		}
+	}
+}
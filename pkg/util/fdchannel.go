@@ -19,6 +19,7 @@ limitations under the License.
 package util
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"syscall"
@@ -26,6 +27,9 @@ import (
 	"k8s.io/klog/v2"
 )
 
+// ErrNoFd is returned by RecvMsg with the received message when no fd is passed with it.
+var ErrNoFd = errors.New("no fd is received")
+
 func SendMsg(via net.Conn, fd int, msg []byte) error {
 	klog.V(4).Info("get the underlying socket")
 	conn, ok := via.(*net.UnixConn)
@@ -51,29 +55,28 @@ func RecvMsg(via net.Conn) (int, []byte, error) {
 	if !ok {
 		return 0, nil, fmt.Errorf("failed to cast via to *net.UnixConn")
 	}
-	connf, err := conn.File()
-	if err != nil {
-		return 0, nil, err
-	}
-	socket := int(connf.Fd())
-	defer connf.Close()
 
 	klog.V(4).Info("calling recvmsg...")
 	buf := make([]byte, syscall.CmsgSpace(4))
 	b := make([]byte, 500)
-	//nolint:dogsled
-	n, _, _, _, err := syscall.Recvmsg(socket, b, buf, 0)
+	// ReadMsgUnix receives the fd with close-on-exec, so that it does not leak to processes executed later,
+	// like hooks and the mounters of other volumes. It also respects the deadline of via.
+	n, oobn, _, _, err := conn.ReadMsgUnix(b, buf)
 	if err != nil {
 		return 0, nil, err
 	}
 
 	klog.V(4).Info("parsing SCM...")
 	var msgs []syscall.SocketControlMessage
-	msgs, err = syscall.ParseSocketControlMessage(buf)
+	msgs, err = syscall.ParseSocketControlMessage(buf[:oobn])
 	if err != nil {
 		return 0, nil, err
 	}
 
+	if len(msgs) == 0 {
+		return -1, b[:n], ErrNoFd
+	}
+
 	klog.V(4).Info("parsing SCM_RIGHTS...")
 	fds, err := syscall.ParseUnixRights(&msgs[0])
 	if err != nil {
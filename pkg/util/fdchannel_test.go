@@ -0,0 +1,106 @@
+/*
+Copyright 2023 Preferred Networks, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    https://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestRecvMsg(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name          string
+		sendFd        bool
+		expectedError error
+	}{
+		{
+			name:   "should receive the fd as close-on-exec",
+			sendFd: true,
+		},
+		{
+			name:          "should return the message without the fd",
+			sendFd:        false,
+			expectedError: ErrNoFd,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+
+		sp := filepath.Join(t.TempDir(), "test.sock")
+		l, err := net.Listen("unix", sp)
+		if err != nil {
+			t.Fatalf("failed to listen on %q: %v", sp, err)
+		}
+		client, err := net.Dial("unix", sp)
+		if err != nil {
+			t.Fatalf("failed to connect to %q: %v", sp, err)
+		}
+		server, err := l.Accept()
+		if err != nil {
+			t.Fatalf("failed to accept: %v", err)
+		}
+
+		if tc.sendFd {
+			f, err := os.Open(os.DevNull)
+			if err != nil {
+				t.Fatalf("failed to open %q: %v", os.DevNull, err)
+			}
+			err = SendMsg(server, int(f.Fd()), []byte("msg"))
+			f.Close()
+			if err != nil {
+				t.Fatalf("failed to send the fd: %v", err)
+			}
+		} else if _, err := server.Write([]byte("msg")); err != nil {
+			t.Fatalf("failed to send the message: %v", err)
+		}
+
+		fd, msg, err := RecvMsg(client)
+		server.Close()
+		client.Close()
+		l.Close()
+		if string(msg) != "msg" {
+			t.Errorf("Got message %q, but expected %q", msg, "msg")
+		}
+		if tc.expectedError != nil {
+			if !errors.Is(err, tc.expectedError) {
+				t.Errorf("Got error %v, but expected %v", err, tc.expectedError)
+			}
+
+			continue
+		}
+		if err != nil {
+			t.Errorf("Did not expect error but got: %v", err)
+			continue
+		}
+		flags, err := unix.FcntlInt(uintptr(fd), unix.F_GETFD, 0)
+		syscall.Close(fd)
+		if err != nil {
+			t.Errorf("Did not expect error but got: %v", err)
+		} else if flags&unix.FD_CLOEXEC == 0 {
+			t.Errorf("Expected the received fd to be close-on-exec but it is not")
+		}
+	}
+}